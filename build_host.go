@@ -0,0 +1,68 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// buildHostSchema is the connection to a remote machine builds run on.
+func buildHostSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Optional: true,
+		MaxItems: 1,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"host": &schema.Schema{
+					Type:     schema.TypeString,
+					Required: true,
+				},
+				"user": &schema.Schema{
+					Type:     schema.TypeString,
+					Optional: true,
+					Default:  "root",
+				},
+				// The ssh default when not set.
+				"port": &schema.Schema{
+					Type:     schema.TypeInt,
+					Optional: true,
+				},
+				"private_key": &schema.Schema{
+					Type:      schema.TypeString,
+					Optional:  true,
+					Sensitive: true,
+				},
+				"bastion": &schema.Schema{
+					Type:         schema.TypeString,
+					Optional:     true,
+					ValidateFunc: validation.StringMatch(regexp.MustCompile(`^\S*$`), "must not contain whitespace"),
+				},
+				"system": &schema.Schema{
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+			},
+		},
+	}
+}
+
+// getBuildHost returns the build host, or nil to build locally.
+func getBuildHost(d resourceLike) *nix.BuildHost {
+	blocks := d.Get("build_host").([]interface{})
+	if len(blocks) == 0 || blocks[0] == nil {
+		return nil
+	}
+
+	block := blocks[0].(map[string]interface{})
+	return &nix.BuildHost{
+		Host:       block["host"].(string),
+		User:       block["user"].(string),
+		Port:       block["port"].(int),
+		PrivateKey: block["private_key"].(string),
+		Bastion:    block["bastion"].(string),
+		System:     block["system"].(string),
+	}
+}
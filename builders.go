@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// buildersSchema is a pool of remote machines builds may be offloaded to.
+func buildersSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Optional: true,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"uri": &schema.Schema{
+					Type:     schema.TypeString,
+					Required: true,
+				},
+				"systems": &schema.Schema{
+					Type:     schema.TypeList,
+					Optional: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"ssh_key": &schema.Schema{
+					Type:      schema.TypeString,
+					Optional:  true,
+					Sensitive: true,
+				},
+				"max_jobs": &schema.Schema{
+					Type:     schema.TypeInt,
+					Optional: true,
+				},
+				"speed_factor": &schema.Schema{
+					Type:     schema.TypeInt,
+					Optional: true,
+				},
+				"supported_features": &schema.Schema{
+					Type:     schema.TypeList,
+					Optional: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"mandatory_features": &schema.Schema{
+					Type:     schema.TypeList,
+					Optional: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"public_host_key": &schema.Schema{
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+			},
+		},
+	}
+}
+
+func toStringList(l []interface{}) []string {
+	s := make([]string, 0, len(l))
+	for _, v := range l {
+		s = append(s, v.(string))
+	}
+	return s
+}
+
+func expandBuilders(blocks []interface{}) nix.Builders {
+	builders := make(nix.Builders, 0, len(blocks))
+	for _, b := range blocks {
+		block := b.(map[string]interface{})
+		builders = append(builders, nix.Builder{
+			URI:               block["uri"].(string),
+			Systems:           toStringList(block["systems"].([]interface{})),
+			SSHKey:            block["ssh_key"].(string),
+			MaxJobs:           block["max_jobs"].(int),
+			SpeedFactor:       block["speed_factor"].(int),
+			SupportedFeatures: toStringList(block["supported_features"].([]interface{})),
+			MandatoryFeatures: toStringList(block["mandatory_features"].([]interface{})),
+			PublicHostKey:     block["public_host_key"].(string),
+		})
+	}
+	return builders
+}
+
+// getPlatform returns the platform a resource builds for.
+func getPlatform(d resourceLike) nix.Platform {
+	return nix.Platform{
+		System:      d.Get("system").(string),
+		CrossSystem: d.Get("cross_system").(string),
+	}
+}
+
+// getBuilders returns the builders of a resource, or those of the provider
+// if the resource sets none.
+func getBuilders(d resourceLike, m interface{}) nix.Builders {
+	if blocks := d.Get("builders").([]interface{}); len(blocks) != 0 {
+		return expandBuilders(blocks)
+	}
+
+	if cfg, ok := m.(*providerConfig); ok {
+		return cfg.Builders
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// closureDiffSchema is the packages that changed between the closures of
+// the previous and current store path. change is one of added, removed,
+// upgraded, or resized for packages only changed in size.
+func closureDiffSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Computed: true,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"name": &schema.Schema{
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"change": &schema.Schema{
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"old_versions": &schema.Schema{
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"new_versions": &schema.Schema{
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"size_delta": &schema.Schema{
+					Type:     schema.TypeInt,
+					Computed: true,
+				},
+			},
+		},
+	}
+}
+
+func flattenClosureDiff(changes []nix.ClosureChange) []interface{} {
+	diff := make([]interface{}, 0, len(changes))
+	for _, c := range changes {
+		diff = append(diff, map[string]interface{}{
+			"name":         c.Name,
+			"change":       c.Change,
+			"old_versions": c.OldVersions,
+			"new_versions": c.NewVersions,
+			"size_delta":   int(c.SizeDelta),
+		})
+	}
+	return diff
+}
+
+func isStorePath(p string) bool {
+	return strings.HasPrefix(p, "/nix/store/")
+}
+
+// planClosureDiff shows what changes between the current and desired
+// store paths in the plan. When the diff cannot be computed now, it is left
+// to be filled in by the apply.
+func planClosureDiff(d *schema.ResourceDiff, before, after string) error {
+	if !isStorePath(before) || !isStorePath(after) {
+		return d.SetNewComputed("closure_diff")
+	}
+
+	diff, err := nix.DiffClosures(before, after)
+	if err != nil {
+		log.Printf("closure diff failed, deferring to apply. err=%s", err.Error())
+		return d.SetNewComputed("closure_diff")
+	}
+
+	return d.SetNew("closure_diff", flattenClosureDiff(diff))
+}
+
+// setClosureDiff records what changed between two store paths after an apply.
+// Failing to diff is not fatal, the old path may simply have been garbage
+// collected.
+func setClosureDiff(d *schema.ResourceData, before, after string) error {
+	var diff []nix.ClosureChange
+
+	if isStorePath(before) && isStorePath(after) && before != after {
+		var err error
+		diff, err = nix.DiffClosures(before, after)
+		if err != nil {
+			log.Printf("closure diff failed. err=%s", err.Error())
+			diff = nil
+		}
+	}
+
+	return d.Set("closure_diff", flattenClosureDiff(diff))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// logDirSchema is a directory the complete output of builds, switches and hooks is kept in.
+func logDirSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeString,
+		Optional: true,
+	}
+}
+
+func lastLogPathSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeString,
+		Computed: true,
+	}
+}
+
+// getCommandLog returns the log for the log_dir of a resource, or that of the
+// provider if the resource sets none. It is nil if neither sets a log_dir.
+func getCommandLog(d resourceLike, m interface{}) (*nix.CommandLog, error) {
+	logDir := d.Get("log_dir").(string)
+	if cfg, ok := m.(*providerConfig); ok && logDir == "" {
+		logDir = cfg.LogDir
+	}
+
+	if logDir == "" {
+		return nil, nil
+	}
+
+	logDir, err := filepath.Abs(logDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nix.CommandLog{Dir: logDir}, nil
+}
+
+// planLastLogPath marks last_log_path as changed by the apply, if output is being logged.
+func planLastLogPath(d *schema.ResourceDiff, m interface{}) error {
+	cmdLog, err := getCommandLog(d, m)
+	if err != nil || cmdLog == nil {
+		return err
+	}
+	return d.SetNewComputed("last_log_path")
+}
+
+// setLastLogPath records the file the most recent command was logged to.
+func setLastLogPath(d *schema.ResourceData, cmdLog *nix.CommandLog) error {
+	if cmdLog == nil || cmdLog.LastPath == "" {
+		return nil
+	}
+	return d.Set("last_log_path", cmdLog.LastPath)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+func dataSourceDiskLayout() *schema.Resource {
+	return &schema.Resource{
+		Read: dataDiskLayoutRead,
+		Schema: map[string]*schema.Schema{
+			"disk": &schema.Schema{
+				Type:     schema.TypeList,
+				Required: true,
+				MinItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"device": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"partition": &schema.Schema{
+							Type:     schema.TypeList,
+							Required: true,
+							MinItems: 1,
+							Elem: &schema.Resource{
+								Schema: map[string]*schema.Schema{
+									"name": &schema.Schema{
+										Type:     schema.TypeString,
+										Required: true,
+									},
+									"size": &schema.Schema{
+										Type:     schema.TypeString,
+										Optional: true,
+									},
+									"type": &schema.Schema{
+										Type:         schema.TypeString,
+										Optional:     true,
+										Default:      "linux",
+										ValidateFunc: validation.StringInSlice([]string{"linux", "efi", "bios", "swap", "luks"}, false),
+									},
+									"filesystem": &schema.Schema{
+										Type:         schema.TypeString,
+										Optional:     true,
+										ValidateFunc: validation.StringInSlice([]string{"ext4", "xfs", "btrfs", "vfat", "swap"}, false),
+									},
+									"mount_point": &schema.Schema{
+										Type:     schema.TypeString,
+										Optional: true,
+									},
+									"mount_options": &schema.Schema{
+										Type:     schema.TypeList,
+										Optional: true,
+										Elem:     &schema.Schema{Type: schema.TypeString},
+									},
+									"luks": &schema.Schema{
+										Type:     schema.TypeList,
+										Optional: true,
+										MaxItems: 1,
+										Elem: &schema.Resource{
+											Schema: map[string]*schema.Schema{
+												"name": &schema.Schema{
+													Type:     schema.TypeString,
+													Required: true,
+												},
+												"passphrase": &schema.Schema{
+													Type:      schema.TypeString,
+													Required:  true,
+													Sensitive: true,
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			"partition_script": &schema.Schema{
+				Type:      schema.TypeString,
+				Computed:  true,
+				Sensitive: true,
+			},
+			"nixos_module": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func getDiskLayout(d resourceLike) nix.DiskLayout {
+	layout := nix.DiskLayout{}
+
+	for _, rawDisk := range d.Get("disk").([]interface{}) {
+		diskMap := rawDisk.(map[string]interface{})
+		disk := nix.Disk{
+			Device: diskMap["device"].(string),
+		}
+
+		for _, rawPartition := range diskMap["partition"].([]interface{}) {
+			partitionMap := rawPartition.(map[string]interface{})
+			partition := nix.Partition{
+				Name:       partitionMap["name"].(string),
+				Size:       partitionMap["size"].(string),
+				Type:       partitionMap["type"].(string),
+				Filesystem: partitionMap["filesystem"].(string),
+				MountPoint: partitionMap["mount_point"].(string),
+			}
+
+			for _, opt := range partitionMap["mount_options"].([]interface{}) {
+				partition.MountOptions = append(partition.MountOptions, opt.(string))
+			}
+
+			if luks := partitionMap["luks"].([]interface{}); len(luks) != 0 {
+				luksMap := luks[0].(map[string]interface{})
+				partition.Luks = &nix.Luks{
+					Name:       luksMap["name"].(string),
+					Passphrase: luksMap["passphrase"].(string),
+				}
+			}
+
+			disk.Partitions = append(disk.Partitions, partition)
+		}
+
+		layout.Disks = append(layout.Disks, disk)
+	}
+
+	return layout
+}
+
+func dataDiskLayoutRead(d *schema.ResourceData, m interface{}) error {
+	layout := getDiskLayout(d)
+
+	script, err := layout.PartitionScript()
+	if err != nil {
+		return err
+	}
+
+	module, err := layout.NixosModule()
+	if err != nil {
+		return err
+	}
+
+	err = nix.CheckNixSyntax(module)
+	if err != nil {
+		return err
+	}
+
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	err = d.Set("partition_script", script)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("nixos_module", module)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
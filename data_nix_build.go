@@ -11,6 +11,7 @@ func dataSourceNixBuild() *schema.Resource {
 	return &schema.Resource{
 		Read: dataNixBuildRead,
 		Schema: map[string]*schema.Schema{
+			"builders": buildersSchema(),
 			"nix_path": &schema.Schema{
 				Type:     schema.TypeString,
 				Optional: true,
@@ -35,7 +36,7 @@ func dataNixBuildRead(d *schema.ResourceData, m interface{}) error {
 
 	expressionPath := d.Get("expression_path").(string)
 
-	storePath, err := nix.BuildExpression(nixPath, expressionPath, nil)
+	storePath, err := nix.BuildExpression(nixPath, expressionPath, nil, getBuilders(d, m), nix.Platform{}, nil)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Read only information about a nixos host, managed by terraform or not.
+func dataSourceNixOSHost() *schema.Resource {
+	return &schema.Resource{
+		Read: dataNixOSHostRead,
+		Schema: map[string]*schema.Schema{
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"current_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"booted_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"generation": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"generations": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"generation": &schema.Schema{
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+						"system": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+			"nixos_version": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"kernel_version": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"architecture": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"nix_free_bytes": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"failed_units": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"machine_id": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataNixOSHostRead(d *schema.ResourceData, m interface{}) error {
+	user := d.Get("target_user").(string)
+	host := d.Get("target_host").(string)
+	sshOpts := d.Get("ssh_opts").(string)
+	sshTimeout := time.Duration(d.Get("ssh_timeout").(int)) * time.Second
+
+	err := nix.WaitForSSH(user, host, sshOpts, sshTimeout)
+	if err != nil {
+		return err
+	}
+
+	info, err := nix.GetHostInfo(user, host, sshOpts)
+	if err != nil {
+		return err
+	}
+
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	generations := make([]interface{}, 0, len(info.Generations))
+	for _, g := range info.Generations {
+		generations = append(generations, map[string]interface{}{
+			"generation": g.Number,
+			"system":     g.System,
+		})
+	}
+
+	values := map[string]interface{}{
+		"current_system": info.CurrentSystem,
+		"booted_system":  info.BootedSystem,
+		"generation":     info.Generation,
+		"generations":    generations,
+		"nixos_version":  info.NixosVersion,
+		"kernel_version": info.KernelVersion,
+		"architecture":   info.Architecture,
+		"nix_free_bytes": int(info.NixFreeBytes),
+		"failed_units":   info.FailedUnits,
+		"machine_id":     info.MachineID,
+	}
+
+	for k, v := range values {
+		err = d.Set(k, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
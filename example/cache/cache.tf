@@ -0,0 +1,26 @@
+resource "nix_build" "hello" {
+  expression      = "(import <nixpkgs> {}).hello"
+  expression_path = "./hello-generated.nix"
+  out_link        = "./hello"
+}
+
+resource "nix_cache_push" "hello" {
+  # The closure of this store path is copied to the cache.
+  store_path = "${nix_build.hello.store_path}"
+
+  # Any nix store url, for example:
+  #  - file:///var/cache/nix
+  #  - s3://bucket?endpoint=minio.example.com&region=us-east-1
+  #  - ssh-ng://cache.example.com
+  cache_url = "file:///tmp/example-nix-cache"
+
+  # Optional, sign the closure with this key, as generated by nix-store --generate-binary-cache-key.
+  # secret_key = "${file("./cache-key.sec")}"
+  # Or read the key from a file, which keeps it out of the terraform state.
+  # secret_key_file = "./cache-key.sec"
+}
+
+# The paths the cache did not already have when last pushed.
+output "uploaded_paths" {
+  value = "${nix_cache_push.hello.uploaded_paths}"
+}
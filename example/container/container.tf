@@ -0,0 +1,39 @@
+variable "target_host" {
+  # A nixos host, containers need no extra configuration on it.
+}
+
+resource "nix_nixos_container" "staging" {
+  name        = "staging"
+  target_host = "${var.target_host}"
+
+  # The configuration of the container, boot.isContainer is set for you.
+  nixos_config = <<-EOF
+  { pkgs, ... }: {
+    services.nginx.enable = true;
+    networking.firewall.allowedTCPPorts = [ 80 ];
+  }
+  EOF
+
+  nixos_config_path = "./staging-generated.nix"
+
+  # Give the container a private network, reachable from the host at local_address.
+  host_address  = "10.233.1.1"
+  local_address = "10.233.1.2"
+
+  # Optional values, with defaults.
+
+  # Stop the container without destroying it.
+  # running = true
+
+  # nix_path    = "$NIX_PATH"
+  # target_user = "root"
+
+  # Keep the complete output of builds, as for the provider.
+  # log_dir = "./logs"
+
+  # The connection and copy options are the same as nix_copy_closure.
+}
+
+output "staging_ip" {
+  value = "${nix_nixos_container.staging.ip_address}"
+}
@@ -0,0 +1,89 @@
+variable "target_host" {
+  # Any host with nix installed, it does not need to run nixos.
+}
+
+resource "nix_build" "hello" {
+  expression      = "(import <nixpkgs> {}).hello"
+  expression_path = "./hello-generated.nix"
+  out_link        = "./hello"
+}
+
+resource "nix_copy_closure" "hello" {
+  # The closure of this store path is copied to the target.
+  store_path  = "${nix_build.hello.store_path}"
+  target_host = "${var.target_host}"
+
+  # Optional values, with defaults.
+
+  # target_user = "root"
+  # ssh_opts    = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
+  # ssh_timeout = 180
+
+  # Let the target fetch what it can from its own substituters.
+  # use_substitutes = false
+
+  # Enable ssh level compression.
+  # compress = false
+
+  # Compress the copied paths with "gzip" or "zstd", zstd must be installed on both ends.
+  # compression = ""
+
+  # The closure is protected from nix-collect-garbage on the target by a root at
+  # /nix/var/nix/gcroots/per-user/<target_user>/<gc_root_name>, removed on destroy.
+  # gc_root_name = "terraform-<random>"
+}
+
+output "gc_root" {
+  value = "${nix_copy_closure.hello.gc_root}"
+}
+
+# A named profile on the target, with generations like any other nix profile.
+resource "nix_profile" "tools" {
+  # Usually a buildEnv of the packages to install.
+  store_path   = "${nix_build.hello.store_path}"
+  profile_path = "/nix/var/nix/profiles/per-user/root/tools"
+  target_host  = "${var.target_host}"
+
+  # Switch the profile back to its previous generation on destroy,
+  # otherwise it is left as is.
+  # rollback_on_destroy = false
+
+  # The connection and copy options are the same as nix_copy_closure.
+}
+
+output "tools_generation" {
+  value = "${nix_profile.tools.generation}"
+}
+
+# Systemd services built with nix on a host without nixos.
+resource "nix_build" "units" {
+  expression = <<-EOF
+  let
+    pkgs = import <nixpkgs> {};
+  in
+    pkgs.writeTextDir "hello.service" ''
+      [Unit]
+      Description=Say hello
+
+      [Service]
+      Type=oneshot
+      ExecStart=$${pkgs.hello}/bin/hello
+    ''
+  EOF
+
+  expression_path = "./units-generated.nix"
+  out_link        = "./units"
+}
+
+resource "nix_systemd_units" "units" {
+  # A directory of unit files, each is linked into /etc/systemd/system.
+  # After a daemon-reload, new units are started, changed units restarted
+  # and removed units stopped. On destroy all units are stopped and removed.
+  units_path  = "${nix_build.units.store_path}"
+  target_host = "${var.target_host}"
+
+  # The profile keeping the units alive, use a different one for each nix_systemd_units on a host.
+  # profile_path = "/nix/var/nix/profiles/systemd-units"
+
+  # The connection and copy options are the same as nix_copy_closure.
+}
@@ -9,6 +9,30 @@ provider "google" {
   region  = "us-central1"
 }
 
+provider "nix" {
+  # Remote machines every build may be offloaded to, passed to nix as --option builders.
+  # Resources accept the same builders blocks, which replace these.
+  # The user running terraform must be trusted by the nix daemon for builders to be used,
+  # nix ignores them for other users with only a warning and builds locally.
+  # builders {
+  #   uri                = "ssh://builder@farm1.example.com"
+  #   systems            = ["aarch64-linux"]
+  #   ssh_key            = "${file("~/.ssh/farm")}"
+  #   max_jobs           = 8
+  #   speed_factor       = 2
+  #   supported_features = ["big-parallel", "kvm"]
+  #   mandatory_features = []
+  #   # The host key as in known_hosts, without the host name.
+  #   public_host_key    = "ssh-ed25519 AAAA..."
+  # }
+
+  # Keep the complete output of every build, switch and hook in a timestamped
+  # file in this directory. Resources accept log_dir too, which replaces this.
+  # The file of the most recent one is exported as last_log_path. nix_nixos_test
+  # keeps the output of its test runs at its own log_path instead.
+  # log_dir = "./logs"
+}
+
 resource "nix_build" "nixpkgs" {
   # Path to the nix expression to build.
   # If expression is set, this is an output path of
@@ -30,48 +54,53 @@ resource "nix_build" "nixpkgs" {
   # A nix gc root into the nix store.
   # Same as what you get from nix-build -o ...
   out_link = "./pinned_nixpkgs"
+
+  # The platform to build for. system sets builtins.currentSystem and is passed as the
+  # system argument to expressions that are functions accepting one, cross_system is
+  # passed as crossSystem = { system = ...; } the same way.
+  # system       = "aarch64-linux"
+  # cross_system = "aarch64-linux"
+
+  # Build on a remote machine and copy the result back, the same as for nix_nixos.
+  # build_host {
+  #   host = "builder.example.com"
+  # }
 }
 
-resource "nix_build" "nixosimage" {
-  # The nix path used to build the expression, if not set, it is taken from the environment.
+resource "nix_nixos_image" "nixosimage" {
+  # The nix path used to build the image, if not set, it is taken from the environment.
   nix_path = "nixpkgs=${nix_build.nixpkgs.store_path}:sshpubkey=${pathexpand("${var.ssh_pub_key}")}"
 
-  # We can inline expressions, but be sure to escape them properly.
-  # In this example, this expression is building a base vm image to be uploaded to google cloud.
-  expression = <<-EOF
-  let
-    pkgs = ((import <nixpkgs>) {});
-    
-    configuration = {config, pkgs, ...}: {
-      imports = [
-        <nixpkgs/nixos/modules/virtualisation/google-compute-image.nix>
+  # An optional configuration to write to nixos_config_path, as with nix_nixos.
+  # In this example we build a base vm image to be uploaded to google cloud.
+  nixos_config = <<-EOF
+  {config, pkgs, ...}:
+  {
+    users.users.root = {
+      openssh.authorizedKeys.keys = [
+        (builtins.readFile <sshpubkey>)
       ];
-
-      users.users.root = {
-        openssh.authorizedKeys.keys = [
-          (builtins.readFile <sshpubkey>)
-        ];
-      };
-
     };
+  }
+  EOF
 
-    nixos = ((import <nixpkgs/nixos>) {
-      configuration = configuration;
-      system = "x86_64-linux";
-    });
+  nixos_config_path = "./vmimage-configuration-generated.nix"
 
-    image = nixos.config.system.build.googleComputeImage;
-  in 
-    pkgs.runCommand "image.tar.gz" {} ''
-      cp --reflink=auto $${image}/*.tar.gz $out
-    ''
-  EOF
+  # The kind of image to build, the matching nixos image module is imported for you.
+  # One of raw, qcow2, iso, gce, amazon, azure, docker, lxc or sd-aarch64.
+  format = "gce"
 
-  # Path to the nix expression to possible write, and then build.
-  expression_path = "./vmimage-generated.nix"
+  # Optionally the nixos_module of a nix_disk_layout, see example/install, imported
+  # alongside the configuration so the image mounts the layout's filesystems.
+  # disk_layout_module = "${data.nix_disk_layout.server.nixos_module}"
 
   # Same as what you get from nix-build -o ...
   out_link = "./nixosimage"
+
+  # Keep the complete output of builds, as for the provider.
+  # log_dir = "./logs/image"
+
+  # The image file itself is exported as image_path, along with image_size and image_sha256.
 }
 
 resource "random_id" "example_suffix" {
@@ -86,7 +115,7 @@ resource "google_storage_bucket" "vmimage_bucket" {
 resource "google_storage_bucket_object" "nixosimage" {
   name   = "nixosimage-${random_id.example_suffix.hex}.raw.tar.gz"
   bucket = "${google_storage_bucket.vmimage_bucket.name}"
-  source = "${nix_build.nixosimage.store_path}"
+  source = "${nix_nixos_image.nixosimage.image_path}"
 }
 
 resource "google_compute_image" "nixosimage" {
@@ -170,8 +199,31 @@ resource "nix_nixos" "nixos" {
 
   # post_switch_hook = ""
 
-  # Used by nixos-rebuild switch and nixos-rebuild build as --build-host.
-  # build_host = "localhost"
+  # Keep the complete output of builds, switches and hooks, as for the provider.
+  # log_dir = "./logs/server"
+
+  # Build the system for another platform, natively with system, or cross compiled
+  # from system (or our own platform) with cross_system. They set nixpkgs.localSystem and
+  # nixpkgs.crossSystem, unless the configuration sets those itself. Only builders for
+  # system are used, without any the nix daemon must emulate it with binfmt and trust the
+  # user running terraform, as extra-platforms is ignored otherwise. The platform
+  # is checked against uname -m of the target before switching.
+  # system       = "aarch64-linux"
+  # cross_system = ""
+
+  # Build the system on a remote machine instead of locally. The result is copied
+  # from the build host to the target directly, the build host connects to the
+  # target with ssh_opts and your ssh agent forwarded.
+  # build_host {
+  #   host        = "builder.example.com"
+  #   user        = "root"
+  #   port        = 22
+  #   private_key = "${file("~/.ssh/builder")}"
+  #   # Reach the build host through a jump host, as with ssh -J.
+  #   bastion     = "jump@bastion.example.com"
+  #   # The platform of the build host, the system is evaluated for it.
+  #   system      = "x86_64-linux"
+  # }
 
   # Time to wait for ssh to become responsive. 
   # ssh_timeout = 180
@@ -180,9 +232,81 @@ resource "nix_nixos" "nixos" {
   # ssh_opts     = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
 
   # Run nix-collect-garbage -d on target host before installing an update.
+  # Note this deletes old generations, so disable it if you want to keep
+  # generations around for pin_generation.
   # collect_garbage = true
 
-  # SSH commands will run as this user, note they must be able to install the system
-  # so values other than root mean little.
+  # Roll back by switching to an existing generation of the system profile on the
+  # target, or to a system store path already present there. While either is set
+  # nixos_config_path is not evaluated. Unset it to go back to deploying the config.
+  # pin_generation = 42
+  # pin_system = "/nix/store/...-nixos-system-..."
+
+  # SSH commands will run as this user, note they must be able to install the system,
+  # so users other than root need use_sudo.
   # target_user = "root"
+
+  # Copy the system as target_user, but set the system profile, activate, collect garbage
+  # and read the current system as root with sudo. Without sudo_password, target_user must
+  # be allowed to run sudo without a password. The user must also be trusted by the nix
+  # daemon, or the system signed by a key it trusts, for the copy to succeed.
+  # use_sudo      = false
+  # sudo_password = ""
+
+  # How target_host is reached, one of the following. Every transport but local requires target_host.
+  #  "ssh"        - target_host is a host name, using ssh_opts.
+  #  "local"      - the machine terraform runs on, target_host may be left out. Commands
+  #                 run with sudo when target_user is not the user running terraform.
+  #  "docker"     - target_host is a running container, as used by docker exec.
+  #  "machinectl" - target_host is a machine registered with systemd-machined.
+  # Other than ssh, the system is built locally, copied over and activated directly
+  # instead of by nixos-rebuild.
+  # transport = "ssh"
+
+  # The /etc/machine-id of the target is recorded on the first deploy. If a different
+  # machine later answers at target_host, for example after an ip address was reused,
+  # switching is refused and a replacement is planned instead.
+  # verify_machine_id = true
+
+  # Recorded with each entry in the deployment history, defaults to $TF_WORKSPACE or "default".
+  # workspace = "${terraform.workspace}"
+
+  # Number of past deployments to keep in the history attribute.
+  # history_size = 10
+}
+
+# Package level changes made by the last update, as computed by nix store diff-closures.
+# Each has the package name, its change (added, removed, upgraded or resized), its
+# old_versions and new_versions, and its size_delta in bytes.
+# The same attribute is available on nix_build resources.
+output "nixos_closure_diff" {
+  value = "${nix_nixos.nixos.closure_diff}"
+}
+
+# Deployment state of the host. history lists the last history_size switches,
+# each with its system, generation, timestamp and workspace.
+output "nixos_generation" {
+  value = "${nix_nixos.nixos.generation}"
+}
+
+output "nixos_history" {
+  value = "${nix_nixos.nixos.history}"
+}
+
+# Read only information about a nixos host, useful for inventory or hosts not managed by nix_nixos.
+data "nix_nixos_host" "exampleserver" {
+  target_host = "${google_compute_instance.exampleserver.network_interface.0.access_config.0.nat_ip}"
+
+  # Optional values, with defaults, as for nix_nixos.
+  # target_user = "root"
+  # ssh_opts    = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
+  # ssh_timeout = 180
+
+  depends_on = ["nix_nixos.nixos"]
+}
+
+# Also available: current_system, booted_system, generation, generations,
+# kernel_version, architecture, nix_free_bytes and machine_id.
+output "exampleserver_failed_units" {
+  value = "${data.nix_nixos_host.exampleserver.failed_units}"
 }
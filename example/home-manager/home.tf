@@ -0,0 +1,49 @@
+variable "target_host" {
+  # Any host with nix installed, it does not need to run nixos.
+}
+
+resource "nix_home_manager" "alice" {
+  # The activation package is built locally, copied to the target,
+  # and activated as this user.
+  user        = "alice"
+  target_host = "${var.target_host}"
+
+  home_config = <<-EOF
+  { pkgs, ... }: {
+    home.username = "alice";
+    home.homeDirectory = "/home/alice";
+    home.stateVersion = "19.09";
+    home.packages = [ pkgs.hello ];
+    programs.git.enable = true;
+  }
+  EOF
+
+  home_config_path = "./alice-generated.nix"
+
+  # Optional values, with defaults.
+
+  # home-manager must be on the nix path, e.g. "home-manager=https://github.com/rycee/home-manager/archive/master.tar.gz".
+  # nix_path = "$NIX_PATH"
+
+  # Connect as root and activate with su, or connect as the user directly.
+  # target_user = "root"
+
+  # Run on the terraform host before and after activation, the same as nix_nixos.
+  # pre_switch_hook  = ""
+  # post_switch_hook = ""
+
+  # Activate an existing home manager generation of the user instead of home_config_path.
+  # pin_generation = 0
+
+  # Activate the previous generation on destroy.
+  # rollback_on_destroy = false
+
+  # Keep the complete output of builds, activations and hooks in this directory.
+  # log_dir = "./logs"
+
+  # The connection and copy options are the same as nix_copy_closure.
+}
+
+output "generation" {
+  value = "${nix_home_manager.alice.generation}"
+}
@@ -0,0 +1,96 @@
+variable "target_host" {
+  # Any linux host reachable as root over ssh, for example a debian cloud vm.
+}
+
+# A declarative disk layout, rendered into a partition script and
+# a nixos module with the matching fileSystems.
+data "nix_disk_layout" "server" {
+  disk {
+    device = "/dev/sda"
+
+    partition {
+      # The gpt partition label, the partition is referred to as /dev/disk/by-partlabel/<name>.
+      name = "ESP"
+
+      # Size with a K, M, G or T suffix, omit on the last partition to use the rest of the disk.
+      size = "512M"
+
+      # One of linux, efi, bios, swap or luks.
+      type = "efi"
+
+      # One of ext4, xfs, btrfs, vfat or swap.
+      filesystem  = "vfat"
+      mount_point = "/boot"
+    }
+
+    partition {
+      name        = "root"
+      filesystem  = "ext4"
+      mount_point = "/"
+
+      # mount_options = ["noatime"]
+
+      # Optionally encrypt the partition, the passphrase is asked for at boot.
+      # luks {
+      #   name       = "cryptroot"
+      #   passphrase = "..."
+      # }
+    }
+  }
+}
+
+locals {
+  nixos_config = <<-EOF
+  {
+    imports = [
+      ./configuration.nix
+      ${data.nix_disk_layout.server.nixos_module}
+    ];
+  }
+  EOF
+}
+
+resource "nix_nixos_install" "server" {
+  # The fresh linux host to install nixos onto.
+  target_host = "${var.target_host}"
+
+  # Same as nix_nixos, the configuration to install.
+  nixos_config      = "${local.nixos_config}"
+  nixos_config_path = "./install-configuration-generated.nix"
+
+  # How to get into an environment nixos can be installed from:
+  #  - "kexec" downloads kexec_url onto the target and kexecs into it.
+  #  - "installer" assumes the target is already running a nixos installer.
+  #  - "lustrate" converts the running system in place with NIXOS_LUSTRATE,
+  #     nix must already be installed on the target and partition_script is unused.
+  # install_method = "kexec"
+
+  # kexec_url = "https://github.com/nix-community/nixos-images/releases/download/nixos-unstable/nixos-kexec-installer-noninteractive-x86_64-linux.tar.gz"
+
+  # Run in the installer, it must partition and format the disks and mount
+  # the target filesystems at /mnt, matching fileSystems in your configuration.
+  # Here it is generated from the declarative layout below, you can also write your own.
+  partition_script = "${data.nix_disk_layout.server.partition_script}"
+
+  # Optional values, with defaults.
+
+  # The host keys change when kexec boots the installer, so you may need
+  # to relax host key checking.
+  # ssh_opts = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
+
+  # Time to wait for ssh, including while the host reboots.
+  # ssh_timeout = 600
+
+  # Reboot into the installed system when done.
+  # reboot = true
+
+  # Keep the complete output of the build and each install step, as for the provider.
+  # log_dir = "./logs"
+}
+
+# Once installed, the host is managed like any other nixos server.
+resource "nix_nixos" "server" {
+  target_host       = "${nix_nixos_install.server.target_host}"
+  nixos_config      = "${local.nixos_config}"
+  nixos_config_path = "./configuration-generated.nix"
+}
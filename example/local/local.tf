@@ -0,0 +1,13 @@
+# Manage the nixos configuration of the machine terraform runs on,
+# such as a self hosted terraform runner.
+resource "nix_nixos" "self" {
+  transport         = "local"
+  nixos_config_path = "/etc/nixos/configuration.nix"
+
+  # Terraform should run as root, or as a user allowed to run sudo without a password.
+  # target_user = "root"
+}
+
+output "system" {
+  value = "${nix_nixos.self.nixos_system}"
+}
@@ -0,0 +1,37 @@
+variable "target_host" {}
+
+resource "nix_nixos_test" "webserver" {
+  # An expression evaluating to a nixosTest. As with nix_build, the expression
+  # is optional and written to expression_path if set.
+  expression = <<-EOF
+  let
+    pkgs = import <nixpkgs> {};
+  in
+    pkgs.nixosTest {
+      name = "webserver";
+      nodes.server = import ./configuration.nix;
+      testScript = ''
+        server.wait_for_unit("nginx.service")
+        server.wait_for_open_port(80)
+      '';
+    }
+  EOF
+
+  expression_path = "./webserver-test-generated.nix"
+
+  # The complete output of the last test run, check here when the test fails.
+  log_path = "./webserver-test.log"
+}
+
+# The deployment only happens once the test has passed, the test reruns
+# whenever the configuration changes.
+resource "nix_nixos" "webserver" {
+  target_host       = "${var.target_host}"
+  nixos_config_path = "./configuration.nix"
+
+  depends_on = ["nix_nixos_test.webserver"]
+}
+
+output "tested_system" {
+  value = "${nix_nixos_test.webserver.passed_system}"
+}
@@ -0,0 +1,40 @@
+resource "nix_build" "image" {
+  expression = <<-EOF
+  let
+    pkgs = import <nixpkgs> {};
+  in
+    pkgs.dockerTools.buildImage {
+      name = "hello";
+      tag = "v1";
+      config.Cmd = [ "$${pkgs.hello}/bin/hello" ];
+    }
+  EOF
+
+  expression_path = "./image-generated.nix"
+  out_link        = "./image"
+}
+
+resource "nix_oci_image" "image" {
+  # A docker archive, as built by dockerTools.buildImage, or an oci image layout.
+  # Either may be a directory, tarball or gzipped tarball.
+  archive_path = "${nix_build.image.store_path}"
+
+  # Optional, push the image to this repository. Without a registry host
+  # the repository is on docker hub. Layers the registry already has are skipped.
+  repository = "localhost:5000/hello"
+
+  # Tags to push, defaulting to the tags recorded in the archive.
+  # tags = ["v1", "latest"]
+
+  # Use http instead of https, for local registries.
+  insecure = true
+
+  # Registry credentials, if required.
+  # username = ""
+  # password = ""
+}
+
+output "image_digest" {
+  # Also available: config_digest, layer_digests and repo_tags.
+  value = "${nix_oci_image.image.manifest_digest}"
+}
@@ -0,0 +1,58 @@
+variable "ssh_pub_key" {
+  default = "~/.ssh/id_rsa.pub"
+}
+
+locals {
+  nixos_config = <<-EOF
+  {config, pkgs, ...}:
+  {
+    users.users.root.openssh.authorizedKeys.keys = [
+      "${trimspace(file(pathexpand(var.ssh_pub_key)))}"
+    ];
+  }
+  EOF
+}
+
+resource "nix_nixos_vm" "test" {
+  # The configuration to boot, openssh is enabled for you.
+  nixos_config      = "${local.nixos_config}"
+  nixos_config_path = "./vm-configuration-generated.nix"
+
+  # Holds the vm disk image, pid file and console log (vm.log). Removed on destroy,
+  # the directory itself is kept if anything else was put in it.
+  state_dir = "./vm-state"
+
+  # Optional values, with defaults.
+
+  # Local port forwarded to ssh in the vm, a free port is picked if not set.
+  # ssh_port = 2222
+
+  # Use kvm acceleration, disable this where /dev/kvm is unavailable, such as some ci runners.
+  # kvm = true
+
+  # Memory in megabytes.
+  # memory = 1024
+
+  # Keep the complete output of builds, as for the provider.
+  # log_dir = "./logs"
+}
+
+# The same resource used for production servers, targeting the vm.
+# The vm mounts the host nix store, so the qemu vm module must stay imported.
+resource "nix_nixos" "test" {
+  target_host = "localhost"
+  ssh_opts    = "-o Port=${nix_nixos_vm.test.ssh_port} -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes"
+
+  nixos_config = <<-EOF
+  {
+    imports = [
+      <nixpkgs/nixos/modules/virtualisation/qemu-vm.nix>
+      (${local.nixos_config})
+    ];
+    services.openssh.enable = true;
+    virtualisation.graphics = false;
+  }
+  EOF
+
+  nixos_config_path = "./configuration-generated.nix"
+}
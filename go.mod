@@ -2,4 +2,7 @@ module github.com/andrewchambers/terraform-provider-nix
 
 go 1.14
 
-require github.com/hashicorp/terraform v0.12.7
+require (
+	github.com/hashicorp/terraform v0.12.7
+	github.com/zclconf/go-cty v1.0.1-0.20190708163926-19588f92a98f
+)
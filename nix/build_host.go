@@ -0,0 +1,244 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BuildHost is a remote machine that builds run on instead of locally.
+type BuildHost struct {
+	Host string
+	User string
+	Port int
+	// PrivateKey is the contents of a private key to connect with.
+	PrivateKey string
+	// Bastion is a jump host, as accepted by ssh -J.
+	Bastion string
+	// System is the platform of the build host, builds are evaluated for it.
+	System string
+}
+
+const buildHostSSHOpts = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
+
+// Address returns user@host.
+func (b *BuildHost) Address() string {
+	return fmt.Sprintf("%s@%s", b.User, b.Host)
+}
+
+// connect returns the ssh arguments for the build host, and a function
+// removing the private key file they may refer to. They are passed to
+// nix-copy-closure in NIX_SSHOPTS, which nix before 2.20 splits on
+// whitespace without unquoting, so no argument may contain whitespace.
+func (b *BuildHost) connect() ([]string, func(), error) {
+	if strings.ContainsAny(b.Bastion, " \t\n") {
+		return nil, nil, fmt.Errorf("bastion %q must not contain whitespace", b.Bastion)
+	}
+
+	args := strings.Fields(buildHostSSHOpts)
+	if b.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(b.Port))
+	}
+	if b.Bastion != "" {
+		args = append(args, "-J", b.Bastion)
+	}
+
+	if b.PrivateKey == "" {
+		return args, func() {}, nil
+	}
+
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+
+	keyPath := filepath.Join(tmpDir, "id")
+	if strings.ContainsAny(keyPath, " \t\n") {
+		cleanup()
+		return nil, nil, fmt.Errorf("private key path %q must not contain whitespace, set TMPDIR to a directory without any", keyPath)
+	}
+	err = ioutil.WriteFile(keyPath, []byte(strings.TrimSpace(b.PrivateKey)+"\n"), 0600)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	args = append(args, "-o", "IdentitiesOnly=yes", "-i", keyPath)
+	return args, cleanup, nil
+}
+
+// run runs script on the build host, returning its trimmed stdout.
+// forwardAgent forwards our ssh agent to the build host.
+func (b *BuildHost) run(script string, forwardAgent bool) (string, error) {
+	return b.runWith(runCommandWithLogging, script, forwardAgent)
+}
+
+// runWith is run, with the ssh command run by runCmd.
+func (b *BuildHost) runWith(runCmd func(*exec.Cmd, io.Writer) error, script string, forwardAgent bool) (string, error) {
+	args, cleanup, err := b.connect()
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	if forwardAgent {
+		args = append(args, "-A")
+	}
+
+	output := bytes.NewBuffer(nil)
+	err = runCmd(sshCommand(b.User, b.Host, shellJoin(args), script), output)
+	if err != nil {
+		return "", fmt.Errorf("running command on build host %s failed: %w", b.Host, formatChildErr(err))
+	}
+
+	return strings.TrimSpace(output.String()), nil
+}
+
+// copyClosure runs nix-copy-closure between us and the build host.
+func (b *BuildHost) copyClosure(direction, storePath string) error {
+	args, cleanup, err := b.connect()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd := exec.Command("nix-copy-closure", append(append([]string{direction, b.Address()}, logFormatArgs...), storePath)...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("NIX_SSHOPTS=%s", strings.Join(args, " ")))
+	err = runNixCommand(cmd, ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("copying closure with build host %s failed: %w", b.Host, formatChildErr(err))
+	}
+	return nil
+}
+
+// Instantiate evaluates an expression for the platform of the build host,
+// returning the derivation. args are passed to nix-instantiate and env is
+// added to its environment.
+func (b *BuildHost) Instantiate(nixPath string, env []string, args ...string) (string, error) {
+	if b.System != "" {
+		args = append([]string{"--option", "system", b.System}, args...)
+	}
+
+	cmd := exec.Command("nix-instantiate", args...)
+	cmd.Env = append(append(os.Environ(), env...), fmt.Sprintf("NIX_PATH=%s", nixPath))
+
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(cmd, output)
+	if err != nil {
+		return "", fmt.Errorf("evaluating expression failed: %w", formatChildErr(err))
+	}
+
+	// Expressions may evaluate to several derivations, we build the first.
+	drvPaths := strings.Fields(output.String())
+	if len(drvPaths) == 0 {
+		return "", fmt.Errorf("expression did not evaluate to a derivation")
+	}
+
+	return drvPaths[0], nil
+}
+
+// Build copies a derivation to the build host and builds it there,
+// returning the output path. The output is left on the build host.
+// The output of the build is kept in cmdLog, which may be nil.
+func (b *BuildHost) Build(drvPath string, cmdLog *CommandLog) (string, error) {
+	err := b.copyClosure("--to", drvPath)
+	if err != nil {
+		return "", err
+	}
+
+	runCmd := func(c *exec.Cmd, stdout io.Writer) error {
+		return cmdLog.runNix(c, stdout, "build")
+	}
+
+	output, err := b.runWith(runCmd, "nix-store --realise --log-format internal-json "+shellQuote(drvPath), false)
+	if err != nil {
+		return "", err
+	}
+
+	outPaths := strings.Fields(output)
+	if len(outPaths) == 0 {
+		return "", fmt.Errorf("building %s on %s produced no output", drvPath, b.Host)
+	}
+
+	return outPaths[0], nil
+}
+
+// Fetch copies the closure of a store path from the build host to our store.
+func (b *BuildHost) Fetch(storePath string) error {
+	return b.copyClosure("--from", storePath)
+}
+
+// CopyTo copies the closure of a store path from the build host directly to
+// target. The build host connects to the target with the target's ssh options,
+// with our ssh agent forwarded to it.
+func (b *BuildHost) CopyTo(target *SSHTarget, storePath string) error {
+	_, err := b.run(fmt.Sprintf("NIX_SSHOPTS=%s nix-copy-closure --to %s %s", shellQuote(target.opts()), shellQuote(target.Address()), shellQuote(storePath)), true)
+	return err
+}
+
+// EvaluateExpressionOn returns the store path building a nix expression for
+// platform on the build host would produce, without building it.
+func EvaluateExpressionOn(b *BuildHost, nixPath string, expressionPath string, platform Platform) (string, error) {
+	drvPath, err := b.Instantiate(nixPath, nil, append(platform.expressionArgs(), expressionPath)...)
+	if err != nil {
+		return "", err
+	}
+
+	return DerivationOutput(drvPath)
+}
+
+// BuildExpressionOn builds a nix expression for platform on the build host and
+// copies the result back, returning the store path. If outLink is set, it is
+// made a gc root of the result. The output of the build is kept in cmdLog,
+// which may be nil.
+func BuildExpressionOn(b *BuildHost, nixPath string, expressionPath string, outLink *string, platform Platform, cmdLog *CommandLog) (string, error) {
+	drvPath, err := b.Instantiate(nixPath, nil, append(platform.expressionArgs(), expressionPath)...)
+	if err != nil {
+		return "", err
+	}
+
+	storePath, err := b.Build(drvPath, cmdLog)
+	if err != nil {
+		return "", err
+	}
+
+	err = b.Fetch(storePath)
+	if err != nil {
+		return "", err
+	}
+
+	if outLink != nil {
+		cmd := exec.Command("nix-store", "--realise", storePath, "--add-root", *outLink, "--indirect")
+		err = runCommandWithLogging(cmd, ioutil.Discard)
+		if err != nil {
+			return "", fmt.Errorf("creating out link failed: %w", formatChildErr(err))
+		}
+	}
+
+	return storePath, nil
+}
+
+// DerivationOutput returns the output path of a derivation without building it.
+func DerivationOutput(drvPath string) (string, error) {
+	cmd := exec.Command("nix-store", "--query", "--outputs", drvPath)
+
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(cmd, output)
+	if err != nil {
+		return "", fmt.Errorf("querying outputs of %s failed: %w", drvPath, formatChildErr(err))
+	}
+
+	outPaths := strings.Fields(output.String())
+	if len(outPaths) == 0 {
+		return "", fmt.Errorf("%s has no outputs", drvPath)
+	}
+
+	return outPaths[0], nil
+}
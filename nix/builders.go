@@ -0,0 +1,102 @@
+package nix
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Builder is a remote machine nix may offload builds to.
+type Builder struct {
+	// URI is how nix reaches the builder, such as ssh://builder or ssh-ng://builder.
+	URI     string
+	Systems []string
+	// SSHKey is the contents of a private key to connect with.
+	SSHKey            string
+	MaxJobs           int
+	SpeedFactor       int
+	SupportedFeatures []string
+	MandatoryFeatures []string
+	// PublicHostKey is the ssh host key of the builder, as in known_hosts without the host name.
+	PublicHostKey string
+}
+
+// Builders is a pool of remote builders.
+type Builders []Builder
+
+func specField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func specInt(i int) string {
+	if i == 0 {
+		return "-"
+	}
+	return strconv.Itoa(i)
+}
+
+// Spec renders the builders in the format of the nix builders option, with
+// ssh keys written to files in keyDir.
+func (builders Builders) Spec(keyDir string) (string, error) {
+	machines := make([]string, 0, len(builders))
+
+	for i, b := range builders {
+		keyPath := ""
+		if b.SSHKey != "" {
+			keyPath = filepath.Join(keyDir, fmt.Sprintf("builder-%d", i))
+			err := ioutil.WriteFile(keyPath, []byte(strings.TrimSpace(b.SSHKey)+"\n"), 0600)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		hostKey := ""
+		if b.PublicHostKey != "" {
+			hostKey = base64.StdEncoding.EncodeToString([]byte(strings.TrimSpace(b.PublicHostKey)))
+		}
+
+		machines = append(machines, strings.Join([]string{
+			b.URI,
+			specField(strings.Join(b.Systems, ",")),
+			specField(keyPath),
+			specInt(b.MaxJobs),
+			specInt(b.SpeedFactor),
+			specField(strings.Join(b.SupportedFeatures, ",")),
+			specField(strings.Join(b.MandatoryFeatures, ",")),
+			specField(hostKey),
+		}, " "))
+	}
+
+	return strings.Join(machines, " ; "), nil
+}
+
+// options returns the command line options for nix commands to use the
+// builders, and a function removing any key files they refer to. The nix
+// daemon ignores builders, as it does extra-platforms, with only a warning
+// for users it doesn't trust, and builds locally instead.
+func (builders Builders) options() ([]string, func(), error) {
+	if len(builders) == 0 {
+		return nil, func() {}, nil
+	}
+
+	keyDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(keyDir) }
+
+	spec, err := builders.Spec(keyDir)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return []string{"--option", "builders", spec}, cleanup, nil
+}
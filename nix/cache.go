@@ -0,0 +1,192 @@
+package nix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Closure returns the store paths in the closure of a store path.
+func Closure(storePath string) ([]string, error) {
+	cmd := exec.Command("nix-store", "--query", "--requisites", storePath)
+
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(cmd, output)
+	if err != nil {
+		return nil, fmt.Errorf("querying closure failed: %w", formatChildErr(err))
+	}
+
+	return strings.Fields(output.String()), nil
+}
+
+// isBinaryCache reports if a store url refers to a binary cache rather than a remote nix store.
+func isBinaryCache(u *url.URL) bool {
+	switch u.Scheme {
+	case "file", "s3", "http", "https":
+		return true
+	default:
+		return false
+	}
+}
+
+// CacheHasPath reports if a cache has a store path, by looking for its .narinfo.
+func CacheHasPath(cacheURL, storePath string) (bool, error) {
+	missing, err := CacheMissingPaths(cacheURL, []string{storePath})
+	if err != nil {
+		return false, err
+	}
+	return len(missing) == 0, nil
+}
+
+// CacheMissingPaths returns the store paths a cache does not have. Binary
+// caches on disk or http are checked for each .narinfo directly, anything
+// else is queried with a single nix path-info.
+func CacheMissingPaths(cacheURL string, storePaths []string) ([]string, error) {
+	u, err := url.Parse(cacheURL)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+
+	switch u.Scheme {
+	case "file":
+		for _, p := range storePaths {
+			_, err = os.Stat(filepath.Join(u.Path, narinfoName(p)))
+			if os.IsNotExist(err) {
+				missing = append(missing, p)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	case "http", "https":
+		for _, p := range storePaths {
+			narinfoURL := *u
+			narinfoURL.Path = strings.TrimSuffix(u.Path, "/") + "/" + narinfoName(p)
+			resp, err := http.Head(narinfoURL.String())
+			if err != nil {
+				return nil, err
+			}
+			resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusOK:
+			case http.StatusNotFound, http.StatusForbidden:
+				missing = append(missing, p)
+			default:
+				return nil, fmt.Errorf("checking %s failed: %s", narinfoURL.String(), resp.Status)
+			}
+		}
+	default:
+		// Let nix handle s3 credentials and remote stores.
+		valid, err := storeValidPaths(cacheURL, storePaths)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range storePaths {
+			if !valid[p] {
+				missing = append(missing, p)
+			}
+		}
+	}
+
+	return missing, nil
+}
+
+func narinfoName(storePath string) string {
+	return strings.SplitN(filepath.Base(storePath), "-", 2)[0] + ".narinfo"
+}
+
+// storeValidPaths returns which of storePaths a store has. nix path-info
+// --json reports paths it does not have rather than failing on them, as
+// {"path": ..., "valid": false} before nix 2.19 and as a null entry since.
+func storeValidPaths(storeURL string, storePaths []string) (map[string]bool, error) {
+	args := append([]string{"--extra-experimental-features", "nix-command", "path-info", "--json", "--store", storeURL}, storePaths...)
+	cmd := exec.Command("nix", args...)
+
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(cmd, output)
+	if err != nil {
+		return nil, fmt.Errorf("querying %s failed: %w", storeURL, formatChildErr(err))
+	}
+
+	valid := make(map[string]bool)
+
+	var byPath map[string]json.RawMessage
+	if json.Unmarshal(output.Bytes(), &byPath) == nil {
+		for p, info := range byPath {
+			valid[p] = string(info) != "null"
+		}
+		return valid, nil
+	}
+
+	var infos []struct {
+		Path  string `json:"path"`
+		Valid *bool  `json:"valid"`
+	}
+	err = json.Unmarshal(output.Bytes(), &infos)
+	if err != nil {
+		return nil, fmt.Errorf("parsing path info from %s failed: %w", storeURL, err)
+	}
+	for _, info := range infos {
+		valid[info.Path] = info.Valid == nil || *info.Valid
+	}
+	return valid, nil
+}
+
+// PushToCache copies the closure of a store path to a binary cache or remote store,
+// signing it with secretKeyFile if it is not empty. It returns the paths the cache
+// did not already have.
+func PushToCache(cacheURL, secretKeyFile, storePath string) ([]string, error) {
+	u, err := url.Parse(cacheURL)
+	if err != nil {
+		return nil, err
+	}
+
+	closure, err := Closure(storePath)
+	if err != nil {
+		return nil, err
+	}
+
+	missing, err := CacheMissingPaths(cacheURL, closure)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(missing) == 0 {
+		return missing, nil
+	}
+
+	destination := cacheURL
+	if secretKeyFile != "" {
+		if isBinaryCache(u) {
+			// Binary caches sign narinfos as they are written.
+			q := u.Query()
+			q.Set("secret-key", secretKeyFile)
+			signed := *u
+			signed.RawQuery = q.Encode()
+			destination = signed.String()
+		} else {
+			// Remote stores keep the signatures already in our store.
+			cmd := exec.Command("nix", "--extra-experimental-features", "nix-command", "store", "sign", "--key-file", secretKeyFile, "--recursive", storePath)
+			err = runCommandWithLogging(cmd, ioutil.Discard)
+			if err != nil {
+				return nil, fmt.Errorf("signing closure failed: %w", formatChildErr(err))
+			}
+		}
+	}
+
+	cmd := exec.Command("nix", "--extra-experimental-features", "nix-command", "copy", "--to", destination, storePath)
+	err = runCommandWithLogging(cmd, ioutil.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("copying to cache failed: %w", formatChildErr(err))
+	}
+
+	return missing, nil
+}
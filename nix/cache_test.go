@@ -0,0 +1,92 @@
+package nix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	cachedPath   = "/nix/store/aaaa-glibc-2.32"
+	uncachedPath = "/nix/store/bbbb-hello-2.10"
+)
+
+func TestCacheMissingPaths(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		cache, err := ioutil.TempDir("", "cache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cache)
+
+		err = ioutil.WriteFile(filepath.Join(cache, "aaaa.narinfo"), []byte("StorePath: "+cachedPath+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		missing, err := CacheMissingPaths("file://"+cache, []string{cachedPath, uncachedPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(missing, " ") != uncachedPath {
+			t.Fatalf("got missing %v, want only %s", missing, uncachedPath)
+		}
+	})
+
+	// Both the path-info --json formats, queried in one call.
+	outputs := map[string]string{
+		"nix 2.3":  `[{"path":"` + cachedPath + `","narHash":"sha256:x"},{"path":"` + uncachedPath + `","valid":false}]`,
+		"nix 2.19": `{"` + cachedPath + `":{"narHash":"sha256:x"},"` + uncachedPath + `":null}`,
+	}
+	for name, output := range outputs {
+		t.Run(name, func(t *testing.T) {
+			fakeCommand(t, "nix", `[ "$4" = --json ] && [ "$6" = ssh-ng://cache ] && [ $# = 8 ] || exit 1
+echo '`+output+`'
+`)
+
+			missing, err := CacheMissingPaths("ssh-ng://cache", []string{cachedPath, uncachedPath})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(missing, " ") != uncachedPath {
+				t.Fatalf("got missing %v, want only %s", missing, uncachedPath)
+			}
+		})
+	}
+}
+
+func TestPushToCache(t *testing.T) {
+	cache, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+
+	err = ioutil.WriteFile(filepath.Join(cache, "aaaa.narinfo"), []byte("StorePath: "+cachedPath+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := filepath.Join(cache, "calls")
+	fakeCommand(t, "nix-store", "echo "+cachedPath+"\necho "+uncachedPath+"\n")
+	fakeCommand(t, "nix", `echo "$@" >> '`+calls+`'`)
+
+	uploaded, err := PushToCache("file://"+cache, "/run/keys/cache.sec", uncachedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(uploaded, " ") != uncachedPath {
+		t.Fatalf("got uploaded %v, want only %s", uploaded, uncachedPath)
+	}
+
+	b, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--extra-experimental-features nix-command copy --to file://" + cache + "?secret-key=%2Frun%2Fkeys%2Fcache.sec " + uncachedPath + "\n"
+	if string(b) != want {
+		t.Fatalf("got nix calls:\n%s\nwant:\n%s", b, want)
+	}
+}
@@ -3,29 +3,67 @@ package nix
 import (
 	"bufio"
 	"bytes"
-	"fmt"
 	"io"
 	"log"
 	"os/exec"
 	"strconv"
+	"sync"
 )
 
 func runCommandWithLogging(c *exec.Cmd, stdout io.Writer) error {
+	return runCommandWithTranscript(c, stdout, nil)
+}
+
+// runCommandWithTranscript is runCommandWithLogging, but also writes all
+// stdout and stderr lines to transcript, if it is not nil. Any stdin set on
+// the command is kept, it is never logged.
+func runCommandWithTranscript(c *exec.Cmd, stdout io.Writer, transcript io.Writer) error {
+	return runCommand(c, stdout, transcript, nil)
+}
+
+// runNixCommand is runCommandWithLogging for nix commands run with
+// logFormatArgs, which logs the progress of builds and copies as they run.
+func runNixCommand(c *exec.Cmd, stdout io.Writer) error {
+	return runNixCommandWithTranscript(c, stdout, nil)
+}
+
+// runNixCommandWithTranscript is runCommandWithTranscript for nix commands run
+// with logFormatArgs. The transcript has the output as nix would print it
+// without internal-json.
+func runNixCommandWithTranscript(c *exec.Cmd, stdout io.Writer, transcript io.Writer) error {
+	return runCommand(c, stdout, transcript, newBuildProgress(c.Args[0]))
+}
+
+func runCommand(c *exec.Cmd, stdout io.Writer, transcript io.Writer, progress *buildProgress) error {
 	log.Printf("running %v in env %v", c.Args, c.Env)
 
+	var transcriptMu sync.Mutex
+
 	er, ew := io.Pipe()
 	or, ow := io.Pipe()
 	c.Stdout = ow
 	c.Stderr = ew
-	c.Stdin = nil
 
-	capture := func(r io.Reader, label string) {
+	stderrSaver := &prefixSuffixSaver{N: 32 << 10}
+
+	capture := func(r io.Reader, label string, saver io.Writer) {
 		brdr := bufio.NewReader(r)
 
 		for {
 			s, err := brdr.ReadString('\n')
+			if len(s) != 0 && progress != nil {
+				s = progress.parseLine(s)
+			}
 			if len(s) != 0 {
 				log.Printf("[INFO] %s: %s", label, s)
+				if saver != nil {
+					_, _ = io.WriteString(saver, s)
+				}
+				if transcript != nil {
+					transcriptMu.Lock()
+					_, _ = io.WriteString(transcript, s)
+					transcriptMu.Unlock()
+				}
 			}
 			if err != nil {
 				break
@@ -34,14 +72,16 @@ func runCommandWithLogging(c *exec.Cmd, stdout io.Writer) error {
 
 	}
 
-	stderrSaver := &prefixSuffixSaver{N: 32 << 10}
-	terr := io.TeeReader(er, stderrSaver)
 	tout := io.TeeReader(or, stdout)
 
 	ioDone := make(chan struct{})
 
-	go func() { capture(terr, "stderr"); ioDone <- struct{}{} }()
-	go func() { capture(tout, "stdout"); ioDone <- struct{}{} }()
+	if progress != nil {
+		progress.start()
+	}
+
+	go func() { capture(er, "stderr", stderrSaver); ioDone <- struct{}{} }()
+	go func() { capture(tout, "stdout", nil); ioDone <- struct{}{} }()
 
 	err := c.Run()
 
@@ -51,9 +91,21 @@ func runCommandWithLogging(c *exec.Cmd, stdout io.Writer) error {
 	<-ioDone
 	<-ioDone
 
+	if progress != nil {
+		progress.finish()
+	}
+
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
-			err = fmt.Errorf("%s: %v", ee.String(), string(stderrSaver.Bytes()))
+			cerr := &commandError{
+				Args:     c.Args,
+				ExitCode: ee.ExitCode(),
+				Stderr:   string(stderrSaver.Bytes()),
+			}
+			if progress != nil {
+				cerr.BuildLogs = progress.logs()
+			}
+			err = cerr
 		}
 	}
 	return err
@@ -0,0 +1,69 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// CommandLog writes the complete output of builds, switches and hooks to
+// timestamped files in Dir. Errors only keep the start and end of the output.
+type CommandLog struct {
+	Dir string
+	// LastPath is the file written for the most recent command.
+	LastPath string
+}
+
+// create returns a new file for the output of a command, or nil if there is no Dir.
+func (l *CommandLog) create(name string) (*os.File, error) {
+	if l == nil || l.Dir == "" {
+		return nil, nil
+	}
+
+	err := os.MkdirAll(l.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(l.Dir, fmt.Sprintf("%s-%s-*.log", time.Now().Format("20060102T150405"), name))
+	if err != nil {
+		return nil, err
+	}
+
+	l.LastPath = f.Name()
+	return f, nil
+}
+
+// run is runCommandWithLogging, also writing the output to a new file.
+func (l *CommandLog) run(c *exec.Cmd, stdout io.Writer, name string) error {
+	return l.runWith(runCommandWithTranscript, c, stdout, name)
+}
+
+// runNix is runNixCommand, also writing the output to a new file.
+func (l *CommandLog) runNix(c *exec.Cmd, stdout io.Writer, name string) error {
+	return l.runWith(runNixCommandWithTranscript, c, stdout, name)
+}
+
+func (l *CommandLog) runWith(runCmd func(*exec.Cmd, io.Writer, io.Writer) error, c *exec.Cmd, stdout io.Writer, name string) error {
+	f, err := l.create(name)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return runCmd(c, stdout, nil)
+	}
+	defer f.Close()
+
+	err = runCmd(c, stdout, f)
+
+	var ce *commandError
+	if errors.As(err, &ce) {
+		ce.LogPath = f.Name()
+	}
+
+	return err
+}
@@ -0,0 +1,125 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ContainerConfig represents a declarative nixos-container on a nixos host.
+type ContainerConfig struct {
+	Target          SSHTarget
+	Name            string
+	NixPath         string
+	NixosConfigPath string
+	// HostAddress and LocalAddress give the container a private network, if set.
+	HostAddress  string
+	LocalAddress string
+	Builders     Builders
+	// Log keeps the output of builds, if set.
+	Log *CommandLog
+}
+
+// ContainerState is the state of a container on the host.
+type ContainerState struct {
+	Exists  bool
+	System  string
+	Running bool
+	IP      string
+}
+
+// BuildContainer builds the system of the configuration as a container, returning the store path.
+func BuildContainer(cfg *ContainerConfig) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	expression := fmt.Sprintf(`let
+  nixos = import <nixpkgs/nixos> {
+    configuration = {
+      imports = [ %q ];
+      boot.isContainer = true;
+    };
+  };
+in
+  nixos.config.system.build.toplevel
+`, cfg.NixosConfigPath)
+
+	expressionPath := filepath.Join(tmpDir, "container.nix")
+	err = ioutil.WriteFile(expressionPath, []byte(expression), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return BuildExpression(cfg.NixPath, expressionPath, nil, cfg.Builders, Platform{}, cfg.Log)
+}
+
+// nixosContainer runs nixos-container on the host with args.
+func (cfg *ContainerConfig) nixosContainer(args ...string) error {
+	script := "nixos-container"
+	for _, arg := range args {
+		script += " " + shellQuote(arg)
+	}
+	_, err := cfg.Target.Run(script)
+	return err
+}
+
+// ReadContainer returns the state of the container on the host.
+func ReadContainer(cfg *ContainerConfig) (ContainerState, error) {
+	name := shellQuote(cfg.Name)
+	output, err := cfg.Target.Run(fmt.Sprintf(`if test -e /etc/nixos-containers/%s.conf || test -e /etc/containers/%s.conf; then
+  echo "exists=1"
+  echo "system=$(readlink -f /nix/var/nix/profiles/per-container/%s/system)"
+  echo "status=$(nixos-container status %s)"
+  echo "ip=$(nixos-container show-ip %s 2>/dev/null)"
+fi
+`, name, name, name, name, name))
+	if err != nil {
+		return ContainerState{}, err
+	}
+
+	values := parseKeyValues(output)
+	return ContainerState{
+		Exists:  values["exists"] == "1",
+		System:  values["system"],
+		Running: values["status"] == "up",
+		IP:      values["ip"],
+	}, nil
+}
+
+// CreateContainer creates the container running systemPath, which must
+// already be present on the host. The container is not started.
+func CreateContainer(cfg *ContainerConfig, systemPath string) error {
+	args := []string{"create", cfg.Name, "--system-path", systemPath}
+	if cfg.HostAddress != "" {
+		args = append(args, "--host-address", cfg.HostAddress)
+	}
+	if cfg.LocalAddress != "" {
+		args = append(args, "--local-address", cfg.LocalAddress)
+	}
+
+	return cfg.nixosContainer(args...)
+}
+
+// UpdateContainer switches the container to systemPath, activating it if the container is running.
+func UpdateContainer(cfg *ContainerConfig, systemPath string) error {
+	return cfg.nixosContainer("update", cfg.Name, "--system-path", systemPath)
+}
+
+// StartContainer starts the container.
+func StartContainer(cfg *ContainerConfig) error {
+	return cfg.nixosContainer("start", cfg.Name)
+}
+
+// StopContainer stops the container.
+func StopContainer(cfg *ContainerConfig) error {
+	return cfg.nixosContainer("stop", cfg.Name)
+}
+
+// DestroyContainer stops and removes the container and its state.
+func DestroyContainer(cfg *ContainerConfig) error {
+	return cfg.nixosContainer("destroy", cfg.Name)
+}
@@ -0,0 +1,151 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Compression methods for CopyClosure.
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// CopyClosureConfig represents a configuration for copying closures to a host.
+type CopyClosureConfig struct {
+	Target         SSHTarget
+	UseSubstitutes bool
+	// Compress enables ssh level compression.
+	Compress bool
+	// Compression compresses the transferred paths with gzip or zstd.
+	Compression string
+}
+
+func (cfg *CopyClosureConfig) sshOpts() string {
+	if cfg.Compress {
+		return cfg.Target.opts() + " -o Compression=yes"
+	}
+	return cfg.Target.opts()
+}
+
+// CopyClosure copies the closure of a store path to the target's nix store.
+func CopyClosure(cfg *CopyClosureConfig, storePath string) error {
+	switch cfg.Compression {
+	case CompressionNone, CompressionGzip:
+		args := []string{"--to", cfg.Target.Address()}
+		if cfg.Compression == CompressionGzip {
+			args = append(args, "--gzip")
+		}
+		if cfg.UseSubstitutes {
+			args = append(args, "--use-substitutes")
+		}
+		args = append(append(args, logFormatArgs...), storePath)
+
+		cmd := exec.Command("nix-copy-closure", args...)
+		cmd.Env = append(os.Environ(), fmt.Sprintf("NIX_SSHOPTS=%s", cfg.sshOpts()))
+		err := runNixCommand(cmd, ioutil.Discard)
+		if err != nil {
+			return fmt.Errorf("copying closure failed: %w", formatChildErr(err))
+		}
+		return nil
+	case CompressionZstd:
+		return cfg.copyClosureZstd(storePath)
+	default:
+		return fmt.Errorf("unknown compression %q", cfg.Compression)
+	}
+}
+
+// missingPaths returns the paths the target does not have.
+func (cfg *CopyClosureConfig) missingPaths(paths []string) ([]string, error) {
+	quoted := make([]string, 0, len(paths))
+	for _, p := range paths {
+		quoted = append(quoted, shellQuote(p))
+	}
+	target := cfg.Target
+	target.SSHOpts = cfg.sshOpts()
+	output, err := target.Run("nix-store --check-validity --print-invalid " + strings.Join(quoted, " "))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(output), nil
+}
+
+// copyClosureZstd streams the paths the target is missing through zstd,
+// as nix-copy-closure has no zstd support.
+func (cfg *CopyClosureConfig) copyClosureZstd(storePath string) error {
+	closure, err := Closure(storePath)
+	if err != nil {
+		return err
+	}
+
+	missing, err := cfg.missingPaths(closure)
+	if err != nil {
+		return err
+	}
+
+	if cfg.UseSubstitutes && len(missing) != 0 {
+		quoted := make([]string, 0, len(missing))
+		for _, p := range missing {
+			quoted = append(quoted, shellQuote(p))
+		}
+		target := cfg.Target
+		target.SSHOpts = cfg.sshOpts()
+		// Anything that cannot be substituted is copied below.
+		_, _ = target.Run("nix-store --realise " + strings.Join(quoted, " ") + " >/dev/null || true")
+
+		missing, err = cfg.missingPaths(closure)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// The closure is in dependency order, as nix-store --import requires.
+	script := fmt.Sprintf("nix-store --export \"$@\" | zstd -c | ssh %s %s -- 'zstd -dc | nix-store --import'", cfg.sshOpts(), shellQuote(cfg.Target.Address()))
+	cmd := exec.Command("sh", append([]string{"-c", script, "sh"}, missing...)...)
+	err = runCommandWithLogging(cmd, ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("copying closure failed: %w", formatChildErr(err))
+	}
+
+	return nil
+}
+
+var gcRootName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// gcRootDir is where the roots we create live, per remote user.
+const gcRootDir = "/nix/var/nix/gcroots/per-user/$(id -un)"
+
+// AddGCRoot registers a garbage collector root for storePath on the target,
+// returning the path of the root.
+func AddGCRoot(target *SSHTarget, name, storePath string) (string, error) {
+	if !gcRootName.MatchString(name) {
+		return "", fmt.Errorf("invalid gc root name %q", name)
+	}
+
+	return target.Run(fmt.Sprintf(`set -e
+mkdir -p %s
+ln -sfn %s %s/%s
+echo %s/%s
+`, gcRootDir, shellQuote(storePath), gcRootDir, name, gcRootDir, name))
+}
+
+// ReadGCRoot returns the store path a garbage collector root points to, or an empty string
+// if it does not exist.
+func ReadGCRoot(target *SSHTarget, root string) (string, error) {
+	return target.Run(fmt.Sprintf("readlink %s || true", shellQuote(root)))
+}
+
+// RemoveGCRoot removes a garbage collector root from the target.
+func RemoveGCRoot(target *SSHTarget, root string) error {
+	_, err := target.Run(fmt.Sprintf("rm -f %s", shellQuote(root)))
+	return err
+}
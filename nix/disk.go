@@ -0,0 +1,340 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Partition types understood by DiskLayout, with their GPT type codes.
+var partitionTypeCodes = map[string]string{
+	"linux": "8300",
+	"efi":   "EF00",
+	"bios":  "EF02",
+	"swap":  "8200",
+	"luks":  "8309",
+}
+
+// Filesystems understood by DiskLayout, with the command to create them.
+var filesystemMkfs = map[string]string{
+	"ext4":  "mkfs.ext4 -F",
+	"xfs":   "mkfs.xfs -f",
+	"btrfs": "mkfs.btrfs -f",
+	"vfat":  "mkfs.vfat -F 32",
+	"swap":  "mkswap",
+}
+
+var (
+	partitionNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,36}$`)
+	partitionSizeRegexp = regexp.MustCompile(`^[1-9][0-9]*[KMGT]$`)
+	diskDeviceRegexp    = regexp.MustCompile(`^/dev/[A-Za-z0-9/_.-]+$`)
+)
+
+// Luks describes a LUKS container on a partition.
+type Luks struct {
+	Name       string
+	Passphrase string
+}
+
+// Partition describes a GPT partition and what lives on it.
+type Partition struct {
+	// Name is the GPT partition label, partitions are referred to by it.
+	Name string
+	// Size such as 512M or 20G, empty for the remainder of the disk.
+	Size         string
+	Type         string
+	Filesystem   string
+	MountPoint   string
+	MountOptions []string
+	Luks         *Luks
+}
+
+// Disk describes the partitions of a single disk.
+type Disk struct {
+	Device     string
+	Partitions []Partition
+}
+
+// DiskLayout describes disks to be partitioned and mounted for a nixos install.
+type DiskLayout struct {
+	Disks []Disk
+}
+
+func (p *Partition) partitionDevice() string {
+	return "/dev/disk/by-partlabel/" + p.Name
+}
+
+// filesystemDevice is the device holding the filesystem, which is the opened
+// LUKS container if there is one.
+func (p *Partition) filesystemDevice() string {
+	if p.Luks != nil {
+		return "/dev/mapper/" + p.Luks.Name
+	}
+	return p.partitionDevice()
+}
+
+func (l *DiskLayout) partitions() []*Partition {
+	partitions := []*Partition{}
+	for i := range l.Disks {
+		for j := range l.Disks[i].Partitions {
+			partitions = append(partitions, &l.Disks[i].Partitions[j])
+		}
+	}
+	return partitions
+}
+
+// mounts returns the partitions with a mount point, parents before children.
+func (l *DiskLayout) mounts() []*Partition {
+	mounts := []*Partition{}
+	for _, p := range l.partitions() {
+		if p.MountPoint != "" {
+			mounts = append(mounts, p)
+		}
+	}
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(strings.TrimSuffix(mounts[i].MountPoint, "/"), "/") < strings.Count(strings.TrimSuffix(mounts[j].MountPoint, "/"), "/")
+	})
+	return mounts
+}
+
+// Validate checks the layout is consistent and installable.
+func (l *DiskLayout) Validate() error {
+	if len(l.Disks) == 0 {
+		return errors.New("disk layout must have at least one disk")
+	}
+
+	names := make(map[string]bool)
+	mountPoints := make(map[string]bool)
+	luksNames := make(map[string]bool)
+	devices := make(map[string]bool)
+
+	for _, disk := range l.Disks {
+		if !diskDeviceRegexp.MatchString(disk.Device) {
+			return fmt.Errorf("disk device %q must be a path under /dev of letters, digits, '/', '.', '-' or '_'", disk.Device)
+		}
+		if devices[disk.Device] {
+			return fmt.Errorf("disk %s is specified more than once", disk.Device)
+		}
+		devices[disk.Device] = true
+
+		if len(disk.Partitions) == 0 {
+			return fmt.Errorf("disk %s has no partitions", disk.Device)
+		}
+
+		for i, p := range disk.Partitions {
+			if !partitionNameRegexp.MatchString(p.Name) {
+				return fmt.Errorf("partition name %q must be 1-36 letters, digits, '-' or '_'", p.Name)
+			}
+			if names[p.Name] {
+				return fmt.Errorf("partition name %q is used more than once", p.Name)
+			}
+			names[p.Name] = true
+
+			if p.Size == "" {
+				if i != len(disk.Partitions)-1 {
+					return fmt.Errorf("partition %s: only the last partition on a disk may omit its size", p.Name)
+				}
+			} else if !partitionSizeRegexp.MatchString(p.Size) {
+				return fmt.Errorf("partition %s: invalid size %q, expected a number with a K, M, G or T suffix", p.Name, p.Size)
+			}
+
+			if _, ok := partitionTypeCodes[p.Type]; !ok {
+				return fmt.Errorf("partition %s: unknown type %q", p.Name, p.Type)
+			}
+
+			if p.Filesystem != "" {
+				if _, ok := filesystemMkfs[p.Filesystem]; !ok {
+					return fmt.Errorf("partition %s: unknown filesystem %q", p.Name, p.Filesystem)
+				}
+			}
+
+			switch p.Type {
+			case "bios":
+				if p.Filesystem != "" || p.Luks != nil {
+					return fmt.Errorf("partition %s: bios boot partitions cannot hold a filesystem", p.Name)
+				}
+			case "efi":
+				if p.Filesystem != "vfat" || p.Luks != nil {
+					return fmt.Errorf("partition %s: efi partitions must be unencrypted vfat", p.Name)
+				}
+			case "swap":
+				if p.Filesystem != "swap" {
+					return fmt.Errorf("partition %s: swap partitions must have the swap filesystem", p.Name)
+				}
+			}
+
+			if p.Luks != nil {
+				if !partitionNameRegexp.MatchString(p.Luks.Name) {
+					return fmt.Errorf("partition %s: luks name %q must be 1-36 letters, digits, '-' or '_'", p.Name, p.Luks.Name)
+				}
+				if luksNames[p.Luks.Name] {
+					return fmt.Errorf("partition %s: luks name %q is used more than once", p.Name, p.Luks.Name)
+				}
+				luksNames[p.Luks.Name] = true
+				if p.Luks.Passphrase == "" {
+					return fmt.Errorf("partition %s: luks passphrase is required", p.Name)
+				}
+			}
+
+			if p.MountPoint != "" {
+				if p.Filesystem == "" || p.Filesystem == "swap" {
+					return fmt.Errorf("partition %s: a mount point requires a mountable filesystem", p.Name)
+				}
+				if !strings.HasPrefix(p.MountPoint, "/") || strings.ContainsAny(p.MountPoint, " '\"\\$`") {
+					return fmt.Errorf("partition %s: invalid mount point %q", p.Name, p.MountPoint)
+				}
+				if mountPoints[p.MountPoint] {
+					return fmt.Errorf("partition %s: mount point %s is used more than once", p.Name, p.MountPoint)
+				}
+				mountPoints[p.MountPoint] = true
+			}
+
+			for _, opt := range p.MountOptions {
+				if strings.ContainsAny(opt, " '\"\\$`") {
+					return fmt.Errorf("partition %s: invalid mount option %q", p.Name, opt)
+				}
+			}
+		}
+	}
+
+	if !mountPoints["/"] {
+		return errors.New("disk layout must mount a root filesystem at /")
+	}
+
+	return nil
+}
+
+// PartitionScript renders a script that partitions and formats the disks,
+// then mounts the filesystems under /mnt ready for nixos-install.
+// Everything on the disks is destroyed. The script holds any luks
+// passphrases, so run it from stdin rather than as an argument.
+func (l *DiskLayout) PartitionScript() (string, error) {
+	err := l.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	var script bytes.Buffer
+	script.WriteString("set -eu\n\n")
+
+	for _, disk := range l.Disks {
+		fmt.Fprintf(&script, "wipefs -a %s\n", shellQuote(disk.Device))
+		fmt.Fprintf(&script, "sgdisk --zap-all %s\n", shellQuote(disk.Device))
+		for i, p := range disk.Partitions {
+			end := "0"
+			if p.Size != "" {
+				end = "+" + p.Size
+			}
+			fmt.Fprintf(&script, "sgdisk -n %d:0:%s -t %d:%s -c %s %s\n", i+1, end, i+1, partitionTypeCodes[p.Type], shellQuote(fmt.Sprintf("%d:%s", i+1, p.Name)), shellQuote(disk.Device))
+		}
+		script.WriteString("\n")
+	}
+
+	script.WriteString("partprobe || true\nudevadm settle\n\n")
+
+	// Passphrases go through a mode 0600 key file written by the printf
+	// builtin, so they are never in the arguments of a process.
+	keyFile := false
+	for _, p := range l.partitions() {
+		if p.Luks == nil {
+			continue
+		}
+		if !keyFile {
+			script.WriteString("keyfile=$(mktemp)\ntrap 'rm -f \"$keyfile\"' EXIT\n")
+			keyFile = true
+		}
+		fmt.Fprintf(&script, "printf '%%s' %s > \"$keyfile\"\n", shellQuote(p.Luks.Passphrase))
+		fmt.Fprintf(&script, "cryptsetup luksFormat --batch-mode --key-file \"$keyfile\" %s\n", shellQuote(p.partitionDevice()))
+		fmt.Fprintf(&script, "cryptsetup open --key-file \"$keyfile\" %s %s\n", shellQuote(p.partitionDevice()), shellQuote(p.Luks.Name))
+	}
+	if keyFile {
+		script.WriteString("rm -f \"$keyfile\"\n")
+	}
+
+	for _, p := range l.partitions() {
+		if p.Filesystem == "" {
+			continue
+		}
+		fmt.Fprintf(&script, "%s %s\n", filesystemMkfs[p.Filesystem], shellQuote(p.filesystemDevice()))
+	}
+	script.WriteString("\n")
+
+	for _, p := range l.mounts() {
+		target := "/mnt" + strings.TrimSuffix(p.MountPoint, "/")
+		fmt.Fprintf(&script, "mkdir -p %s\n", shellQuote(target))
+		if len(p.MountOptions) != 0 {
+			fmt.Fprintf(&script, "mount -o %s %s %s\n", shellQuote(strings.Join(p.MountOptions, ",")), shellQuote(p.filesystemDevice()), shellQuote(target))
+		} else {
+			fmt.Fprintf(&script, "mount %s %s\n", shellQuote(p.filesystemDevice()), shellQuote(target))
+		}
+	}
+
+	for _, p := range l.partitions() {
+		if p.Filesystem == "swap" {
+			fmt.Fprintf(&script, "swapon %s\n", shellQuote(p.filesystemDevice()))
+		}
+	}
+
+	return script.String(), nil
+}
+
+// NixosModule renders the fileSystems, swapDevices and luks settings
+// matching the layout as a nixos module.
+func (l *DiskLayout) NixosModule() (string, error) {
+	err := l.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	var module bytes.Buffer
+	module.WriteString("{\n")
+
+	for _, p := range l.mounts() {
+		fmt.Fprintf(&module, "  fileSystems.%q = {\n", p.MountPoint)
+		fmt.Fprintf(&module, "    device = %q;\n", p.filesystemDevice())
+		fmt.Fprintf(&module, "    fsType = %q;\n", p.Filesystem)
+		if len(p.MountOptions) != 0 {
+			opts := make([]string, 0, len(p.MountOptions))
+			for _, opt := range p.MountOptions {
+				opts = append(opts, fmt.Sprintf("%q", opt))
+			}
+			fmt.Fprintf(&module, "    options = [ %s ];\n", strings.Join(opts, " "))
+		}
+		module.WriteString("  };\n")
+	}
+
+	swaps := []string{}
+	for _, p := range l.partitions() {
+		if p.Filesystem == "swap" {
+			swaps = append(swaps, fmt.Sprintf("{ device = %q; }", p.filesystemDevice()))
+		}
+	}
+	if len(swaps) != 0 {
+		fmt.Fprintf(&module, "  swapDevices = [ %s ];\n", strings.Join(swaps, " "))
+	}
+
+	for _, p := range l.partitions() {
+		if p.Luks != nil {
+			fmt.Fprintf(&module, "  boot.initrd.luks.devices.%q.device = %q;\n", p.Luks.Name, p.partitionDevice())
+		}
+	}
+
+	module.WriteString("}\n")
+
+	return module.String(), nil
+}
+
+// CheckNixSyntax checks an expression parses, without evaluating it.
+func CheckNixSyntax(expression string) error {
+	cmd := exec.Command("nix-instantiate", "--parse", "-E", expression)
+	err := runCommandWithLogging(cmd, ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("invalid nix expression: %w", formatChildErr(err))
+	}
+	return nil
+}
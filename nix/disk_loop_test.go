@@ -0,0 +1,100 @@
+//go:build loopdevice
+// +build loopdevice
+
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDiskLayoutLoopDevice runs a partition script against a loop device. It
+// needs root, udev and the partitioning tools, so it is only built with
+//
+//	go test -tags loopdevice ./nix
+//
+// The script mounts under /mnt, so it runs in its own mount namespace.
+func TestDiskLayoutLoopDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices need root")
+	}
+	for _, tool := range []string{"losetup", "unshare", "wipefs", "sgdisk", "partprobe", "udevadm", "cryptsetup", "mkfs.vfat", "mkfs.ext4"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "disk-layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "disk.img")
+	err = ioutil.WriteFile(image, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(image, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("losetup", "--find", "--show", "--partscan", image).Output()
+	if err != nil {
+		t.Fatalf("attaching loop device: %s", err)
+	}
+	device := strings.TrimSpace(string(out))
+	defer exec.Command("losetup", "-d", device).Run()
+
+	// Partition labels are global, keep them from clashing with the host's.
+	suffix := fmt.Sprintf("%d", os.Getpid())
+	luksName := "looptest-crypt-" + suffix
+	defer exec.Command("cryptsetup", "close", luksName).Run()
+
+	l := DiskLayout{
+		Disks: []Disk{
+			{
+				Device: device,
+				Partitions: []Partition{
+					{Name: "looptest-esp-" + suffix, Size: "64M", Type: "efi", Filesystem: "vfat", MountPoint: "/boot"},
+					{
+						Name:       "looptest-root-" + suffix,
+						Type:       "luks",
+						Filesystem: "ext4",
+						MountPoint: "/",
+						Luks:       &Luks{Name: luksName, Passphrase: "loop test"},
+					},
+				},
+			},
+		},
+	}
+
+	script, err := l.PartitionScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script = "mount -t tmpfs none /mnt\n" + script + "stat -f -c %T /mnt /mnt/boot\n"
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("unshare", "--mount", "--propagation", "private", "sh", "-s")
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("partition script failed: %s\n%s", err, stderr.String())
+	}
+
+	want := "ext2/ext3\nmsdos\n"
+	if stdout.String() != want {
+		t.Fatalf("got mounts:\n%s\nwant:\n%s", stdout.String(), want)
+	}
+}
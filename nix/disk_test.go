@@ -0,0 +1,313 @@
+package nix
+
+import (
+	"strings"
+	"testing"
+)
+
+// testDiskLayout is a bios and efi bootable layout with encrypted root and swap,
+// plus a second data disk.
+func testDiskLayout() DiskLayout {
+	return DiskLayout{
+		Disks: []Disk{
+			{
+				Device: "/dev/vda",
+				Partitions: []Partition{
+					{Name: "bios", Size: "1M", Type: "bios"},
+					{Name: "ESP", Size: "512M", Type: "efi", Filesystem: "vfat", MountPoint: "/boot"},
+					{Name: "swap", Size: "2G", Type: "swap", Filesystem: "swap"},
+					{
+						Name:         "nixos",
+						Type:         "luks",
+						Filesystem:   "ext4",
+						MountPoint:   "/",
+						MountOptions: []string{"noatime", "discard"},
+						Luks:         &Luks{Name: "cryptroot", Passphrase: "it's secret"},
+					},
+				},
+			},
+			{
+				Device: "/dev/vdb",
+				Partitions: []Partition{
+					{Name: "data", Type: "linux", Filesystem: "xfs", MountPoint: "/var/lib/data"},
+				},
+			},
+		},
+	}
+}
+
+func TestDiskLayoutValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(l *DiskLayout)
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			modify: func(l *DiskLayout) {},
+		},
+		{
+			name:    "no disks",
+			modify:  func(l *DiskLayout) { l.Disks = nil },
+			wantErr: "at least one disk",
+		},
+		{
+			name:    "disk without partitions",
+			modify:  func(l *DiskLayout) { l.Disks[1].Partitions = nil },
+			wantErr: "/dev/vdb has no partitions",
+		},
+		{
+			name:    "device outside /dev",
+			modify:  func(l *DiskLayout) { l.Disks[1].Device = "/tmp/disk.img" },
+			wantErr: "must be a path under /dev",
+		},
+		{
+			name:   "device by id",
+			modify: func(l *DiskLayout) { l.Disks[1].Device = "/dev/disk/by-id/nvme-Samsung_SSD_970_1.0" },
+		},
+		{
+			name:    "device with shell characters",
+			modify:  func(l *DiskLayout) { l.Disks[1].Device = "/dev/vdb; rm -rf /" },
+			wantErr: "must be a path under /dev",
+		},
+		{
+			name:    "device with a newline",
+			modify:  func(l *DiskLayout) { l.Disks[1].Device = "/dev/vdb\nreboot" },
+			wantErr: "must be a path under /dev",
+		},
+		{
+			name:    "same disk twice",
+			modify:  func(l *DiskLayout) { l.Disks[1].Device = "/dev/vda" },
+			wantErr: "/dev/vda is specified more than once",
+		},
+		{
+			name:    "duplicate label",
+			modify:  func(l *DiskLayout) { l.Disks[1].Partitions[0].Name = "nixos" },
+			wantErr: `partition name "nixos" is used more than once`,
+		},
+		{
+			name:    "invalid label",
+			modify:  func(l *DiskLayout) { l.Disks[1].Partitions[0].Name = "my data" },
+			wantErr: "must be 1-36 letters",
+		},
+		{
+			name:    "zero size",
+			modify:  func(l *DiskLayout) { l.Disks[0].Partitions[2].Size = "0G" },
+			wantErr: `invalid size "0G"`,
+		},
+		{
+			name:    "size without unit",
+			modify:  func(l *DiskLayout) { l.Disks[0].Partitions[2].Size = "2048" },
+			wantErr: `invalid size "2048"`,
+		},
+		{
+			// It would take the rest of the disk and overlap the partitions after it.
+			name:    "remainder before another partition",
+			modify:  func(l *DiskLayout) { l.Disks[0].Partitions[2].Size = "" },
+			wantErr: "only the last partition on a disk may omit its size",
+		},
+		{
+			name:    "missing root",
+			modify:  func(l *DiskLayout) { l.Disks[0].Partitions[3].MountPoint = "/home" },
+			wantErr: "must mount a root filesystem at /",
+		},
+		{
+			name:    "duplicate mount point",
+			modify:  func(l *DiskLayout) { l.Disks[1].Partitions[0].MountPoint = "/boot" },
+			wantErr: "mount point /boot is used more than once",
+		},
+		{
+			name:    "relative mount point",
+			modify:  func(l *DiskLayout) { l.Disks[1].Partitions[0].MountPoint = "data" },
+			wantErr: `invalid mount point "data"`,
+		},
+		{
+			name:    "mounted swap",
+			modify:  func(l *DiskLayout) { l.Disks[0].Partitions[2].MountPoint = "/swap" },
+			wantErr: "a mount point requires a mountable filesystem",
+		},
+		{
+			name:    "unknown type",
+			modify:  func(l *DiskLayout) { l.Disks[1].Partitions[0].Type = "zfs" },
+			wantErr: `unknown type "zfs"`,
+		},
+		{
+			name:    "unknown filesystem",
+			modify:  func(l *DiskLayout) { l.Disks[1].Partitions[0].Filesystem = "ntfs" },
+			wantErr: `unknown filesystem "ntfs"`,
+		},
+		{
+			name:    "efi not vfat",
+			modify:  func(l *DiskLayout) { l.Disks[0].Partitions[1].Filesystem = "ext4" },
+			wantErr: "efi partitions must be unencrypted vfat",
+		},
+		{
+			name:    "bios with filesystem",
+			modify:  func(l *DiskLayout) { l.Disks[0].Partitions[0].Filesystem = "ext4" },
+			wantErr: "bios boot partitions cannot hold a filesystem",
+		},
+		{
+			name:    "luks without passphrase",
+			modify:  func(l *DiskLayout) { l.Disks[0].Partitions[3].Luks.Passphrase = "" },
+			wantErr: "luks passphrase is required",
+		},
+		{
+			name: "duplicate luks name",
+			modify: func(l *DiskLayout) {
+				l.Disks[1].Partitions[0].Luks = &Luks{Name: "cryptroot", Passphrase: "x"}
+			},
+			wantErr: `luks name "cryptroot" is used more than once`,
+		},
+		{
+			name: "mount option with shell characters",
+			modify: func(l *DiskLayout) {
+				l.Disks[1].Partitions[0].MountOptions = []string{"noatime$(reboot)"}
+			},
+			wantErr: "invalid mount option",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := testDiskLayout()
+			tc.modify(&l)
+
+			err := l.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+			}
+
+			// Nothing is rendered for an invalid layout.
+			if _, err := l.PartitionScript(); err == nil {
+				t.Fatal("PartitionScript accepted an invalid layout")
+			}
+			if _, err := l.NixosModule(); err == nil {
+				t.Fatal("NixosModule accepted an invalid layout")
+			}
+		})
+	}
+}
+
+func TestDiskLayoutPartitionScript(t *testing.T) {
+	l := testDiskLayout()
+
+	script, err := l.PartitionScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `set -eu
+
+wipefs -a '/dev/vda'
+sgdisk --zap-all '/dev/vda'
+sgdisk -n 1:0:+1M -t 1:EF02 -c '1:bios' '/dev/vda'
+sgdisk -n 2:0:+512M -t 2:EF00 -c '2:ESP' '/dev/vda'
+sgdisk -n 3:0:+2G -t 3:8200 -c '3:swap' '/dev/vda'
+sgdisk -n 4:0:0 -t 4:8309 -c '4:nixos' '/dev/vda'
+
+wipefs -a '/dev/vdb'
+sgdisk --zap-all '/dev/vdb'
+sgdisk -n 1:0:0 -t 1:8300 -c '1:data' '/dev/vdb'
+
+partprobe || true
+udevadm settle
+
+keyfile=$(mktemp)
+trap 'rm -f "$keyfile"' EXIT
+printf '%s' 'it'"'"'s secret' > "$keyfile"
+cryptsetup luksFormat --batch-mode --key-file "$keyfile" '/dev/disk/by-partlabel/nixos'
+cryptsetup open --key-file "$keyfile" '/dev/disk/by-partlabel/nixos' 'cryptroot'
+rm -f "$keyfile"
+mkfs.vfat -F 32 '/dev/disk/by-partlabel/ESP'
+mkswap '/dev/disk/by-partlabel/swap'
+mkfs.ext4 -F '/dev/mapper/cryptroot'
+mkfs.xfs -f '/dev/disk/by-partlabel/data'
+
+mkdir -p '/mnt'
+mount -o 'noatime,discard' '/dev/mapper/cryptroot' '/mnt'
+mkdir -p '/mnt/boot'
+mount '/dev/disk/by-partlabel/ESP' '/mnt/boot'
+mkdir -p '/mnt/var/lib/data'
+mount '/dev/disk/by-partlabel/data' '/mnt/var/lib/data'
+swapon '/dev/disk/by-partlabel/swap'
+`
+
+	if script != want {
+		t.Fatalf("got script:\n%s\nwant:\n%s", script, want)
+	}
+}
+
+func TestDiskLayoutNixosModule(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout DiskLayout
+		want   string
+	}{
+		{
+			name:   "full",
+			layout: testDiskLayout(),
+			want: `{
+  fileSystems."/" = {
+    device = "/dev/mapper/cryptroot";
+    fsType = "ext4";
+    options = [ "noatime" "discard" ];
+  };
+  fileSystems."/boot" = {
+    device = "/dev/disk/by-partlabel/ESP";
+    fsType = "vfat";
+  };
+  fileSystems."/var/lib/data" = {
+    device = "/dev/disk/by-partlabel/data";
+    fsType = "xfs";
+  };
+  swapDevices = [ { device = "/dev/disk/by-partlabel/swap"; } ];
+  boot.initrd.luks.devices."cryptroot".device = "/dev/disk/by-partlabel/nixos";
+}
+`,
+		},
+		{
+			// Mounts are ordered parents first, whatever the order of the partitions.
+			name: "nested mounts",
+			layout: DiskLayout{
+				Disks: []Disk{
+					{
+						Device: "/dev/sda",
+						Partitions: []Partition{
+							{Name: "home", Size: "10G", Type: "linux", Filesystem: "btrfs", MountPoint: "/home"},
+							{Name: "root", Type: "linux", Filesystem: "ext4", MountPoint: "/"},
+						},
+					},
+				},
+			},
+			want: `{
+  fileSystems."/" = {
+    device = "/dev/disk/by-partlabel/root";
+    fsType = "ext4";
+  };
+  fileSystems."/home" = {
+    device = "/dev/disk/by-partlabel/home";
+    fsType = "btrfs";
+  };
+}
+`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			module, err := tc.layout.NixosModule()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if module != tc.want {
+				t.Fatalf("got module:\n%s\nwant:\n%s", module, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// commandError is a command that ran and exited unsuccessfully.
+type commandError struct {
+	Args     []string
+	ExitCode int
+	Stderr   string
+	// BuildLogs is the end of the build log of each derivation built, for
+	// commands run with runNixCommand.
+	BuildLogs map[string][]string
+	// LogPath is the file with the complete output, for commands run with a CommandLog.
+	LogPath string
+}
+
+// commandErrorLines is how much of stderr is shown for errors we don't understand.
+const commandErrorLines = 20
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s exited with status %d:\n%s", e.Args[0], e.ExitCode, lastLines(e.Stderr, commandErrorLines))
+}
+
+// lastLines returns at most the last n non empty lines of s.
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// EvalError is a failure to evaluate a nix expression.
+type EvalError struct {
+	Message string
+	// File, Line and Column locate the error, if nix reported it.
+	File   string
+	Line   int
+	Column int
+	// Trace is the evaluation trace, outermost first, if nix reported it.
+	Trace []string
+}
+
+func (e *EvalError) Error() string {
+	var b strings.Builder
+	b.WriteString("nix evaluation failed")
+	if e.File != "" {
+		fmt.Fprintf(&b, " at %s:%d:%d", e.File, e.Line, e.Column)
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Message)
+	for _, t := range e.Trace {
+		b.WriteString("\n  … ")
+		b.WriteString(t)
+	}
+	return b.String()
+}
+
+// BuildError is a derivation that failed to build.
+type BuildError struct {
+	Derivation string
+	// Message is how the builder failed, such as exit code 1.
+	Message string
+	// LogTail is the end of the build log, as reported by nix.
+	LogTail string
+}
+
+func (e *BuildError) Error() string {
+	msg := fmt.Sprintf("building %s failed", e.Derivation)
+	if e.Message != "" {
+		msg += " with " + e.Message
+	}
+	if e.LogTail != "" {
+		msg += "\n" + e.LogTail
+	}
+	return msg + fmt.Sprintf("\nthe full log is shown by nix log %s", e.Derivation)
+}
+
+// SSHError is a failure to connect to a host over ssh.
+type SSHError struct {
+	Host    string
+	Message string
+}
+
+func (e *SSHError) Error() string {
+	host := e.Host
+	if host == "" {
+		host = "host"
+	}
+	return fmt.Sprintf("unable to connect to %s over ssh: %s, check the host is up and the ssh options and keys are correct", host, e.Message)
+}
+
+// ActivationError is a configuration that failed to activate.
+type ActivationError struct {
+	Host        string
+	FailedUnits []string
+	Message     string
+}
+
+func (e *ActivationError) Error() string {
+	if len(e.FailedUnits) == 0 {
+		return fmt.Sprintf("activating the configuration on %s failed: %s", e.Host, e.Message)
+	}
+	return fmt.Sprintf("activating the configuration on %s failed, the following units failed: %s, see journalctl -u %s on the host", e.Host, strings.Join(e.FailedUnits, ", "), e.FailedUnits[0])
+}
+
+var (
+	buildFailure = regexp.MustCompile(`builder for '(/nix/store/[^']+\.drv)' failed([^\n]*)`)
+	logLines     = regexp.MustCompile(`last [0-9]+ log lines:`)
+	evalLocation = regexp.MustCompile(`at (/[^\s:]+|«[^»]+»):([0-9]+):([0-9]+)`)
+	sshHost      = regexp.MustCompile(`(?:connect to host|resolve hostname) ([^\s:]+)`)
+	nixSSHHost   = regexp.MustCompile(`(?:connect to|connection to|remote store) '(?:ssh(?:-ng)?://)?(?:[^@']*@)?([^']+)'`)
+	failedUnits  = regexp.MustCompile(`the following units failed: ([^\n]+)`)
+)
+
+var sshFailures = []string{
+	"ssh: connect to host",
+	"ssh: Could not resolve hostname",
+	"Permission denied (",
+	"Host key verification failed",
+	"Connection closed by",
+	"Connection timed out during banner exchange",
+	// How nix reports ssh failing, when ssh itself said nothing we know.
+	"cannot connect to '",
+	"failed to start SSH connection to '",
+	"failed to start SSH master connection to '",
+	"cannot open connection to remote store 'ssh",
+}
+
+// evalEvidence are what only evaluation errors print, other nix errors
+// look just the same otherwise.
+var evalEvidence = []string{
+	"while evaluating",
+	"… ",
+	"use '--show-trace'",
+}
+
+// parseBuildError returns the first failed build in stderr, if there is one.
+func parseBuildError(stderr string) *BuildError {
+	m := buildFailure.FindStringSubmatchIndex(stderr)
+	if m == nil {
+		return nil
+	}
+
+	e := &BuildError{
+		Derivation: stderr[m[2]:m[3]],
+		Message:    strings.TrimPrefix(strings.TrimSpace(strings.TrimRight(stderr[m[4]:m[5]], ";")), "with "),
+	}
+
+	rest := stderr[m[1]:]
+	if loc := logLines.FindStringIndex(rest); loc != nil {
+		tail := []string{}
+		for _, line := range strings.Split(rest[loc[1]:], "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "For full logs") || strings.HasPrefix(line, "error:") {
+				break
+			}
+			line = strings.TrimPrefix(strings.TrimPrefix(line, ">"), " ")
+			if line != "" {
+				tail = append(tail, line)
+			}
+		}
+		e.LogTail = strings.Join(tail, "\n")
+	}
+
+	return e
+}
+
+// parseEvalError returns the evaluation error in stderr, if there is one.
+func parseEvalError(stderr string) *EvalError {
+	if !isEvalFailure(stderr) {
+		return nil
+	}
+
+	e := &EvalError{}
+
+	lines := strings.Split(stderr, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "… "):
+			e.Trace = append(e.Trace, strings.TrimPrefix(line, "… "))
+		case strings.HasPrefix(line, "error:") && e.Message == "":
+			msg := strings.TrimSpace(strings.TrimPrefix(line, "error:"))
+			// With --show-trace the message follows the trace.
+			if msg == "" || strings.HasPrefix(msg, "… ") {
+				if msg != "" {
+					e.Trace = append(e.Trace, strings.TrimPrefix(msg, "… "))
+				}
+				continue
+			}
+			e.Message = msg
+			// The location is on the same line for older nix, or follows the message.
+			for _, l := range lines[i:minInt(i+4, len(lines))] {
+				if m := evalLocation.FindStringSubmatch(l); m != nil {
+					e.File = m[1]
+					e.Line, _ = strconv.Atoi(m[2])
+					e.Column, _ = strconv.Atoi(m[3])
+					if loc := evalLocation.FindStringIndex(e.Message); loc != nil {
+						e.Message = strings.TrimSpace(e.Message[:loc[0]])
+					}
+					break
+				}
+			}
+		}
+	}
+
+	if e.Message == "" {
+		return nil
+	}
+
+	return e
+}
+
+// isEvalFailure reports if stderr shows nix failed while evaluating, by an
+// evaluation trace or the location of the error in an expression.
+func isEvalFailure(stderr string) bool {
+	for _, evidence := range evalEvidence {
+		if strings.Contains(stderr, evidence) {
+			return true
+		}
+	}
+	return evalLocation.MatchString(stderr)
+}
+
+// parseSSHError returns the ssh connection failure in stderr, if there is one.
+func parseSSHError(stderr string) *SSHError {
+	for _, line := range strings.Split(stderr, "\n") {
+		for _, failure := range sshFailures {
+			if !strings.Contains(line, failure) {
+				continue
+			}
+			line = strings.TrimSpace(line)
+			e := &SSHError{Message: strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(line, "ssh: "), "error: "))}
+			if m := sshHost.FindStringSubmatch(line); m != nil {
+				e.Host = m[1]
+			} else if m := nixSSHHost.FindStringSubmatch(line); m != nil {
+				e.Host = m[1]
+			}
+			return e
+		}
+	}
+	return nil
+}
+
+// formatChildErr turns the error of a command run by runCommandWithLogging
+// into a typed error when the failure is understood.
+func formatChildErr(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var ce *commandError
+	if !errors.As(err, &ce) {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && len(ee.Stderr) != 0 {
+			return fmt.Errorf("%s: %s", ee.String(), lastLines(string(ee.Stderr), commandErrorLines))
+		}
+		return err
+	}
+
+	return ce.withLogPath(classifyCommandErr(ce))
+}
+
+// withLogPath points err at the complete output of the command, if it was kept.
+func (e *commandError) withLogPath(err error) error {
+	if e.LogPath == "" {
+		return err
+	}
+	return fmt.Errorf("%w\nthe complete output is in %s", err, e.LogPath)
+}
+
+func classifyCommandErr(ce *commandError) error {
+	if e := parseBuildError(ce.Stderr); e != nil {
+		// With internal-json nix may not repeat the log in its error.
+		if lines := ce.BuildLogs[e.Derivation]; e.LogTail == "" && len(lines) != 0 {
+			if len(lines) > 10 {
+				lines = lines[len(lines)-10:]
+			}
+			e.LogTail = strings.Join(lines, "\n")
+		}
+		return e
+	}
+
+	// Whatever ssh exits with, the tools running it exit with their own
+	// status, and nix reports the failure as an error of its own.
+	if e := parseSSHError(ce.Stderr); e != nil {
+		return e
+	}
+
+	if e := parseEvalError(ce.Stderr); e != nil {
+		return e
+	}
+
+	return ce
+}
+
+// activationErr turns the error of a failed switch into an ActivationError
+// when the configuration was built and activation itself failed.
+func activationErr(host string, err error) error {
+	var ce *commandError
+	if !errors.As(err, &ce) || classifyCommandErr(ce) != error(ce) {
+		return formatChildErr(err)
+	}
+
+	e := &ActivationError{Host: host, Message: lastLines(ce.Stderr, 1)}
+	if m := failedUnits.FindStringSubmatch(ce.Stderr); m != nil {
+		for _, unit := range strings.Split(m[1], ",") {
+			if unit = strings.TrimSpace(unit); unit != "" {
+				e.FailedUnits = append(e.FailedUnits, unit)
+			}
+		}
+	} else if !strings.Contains(ce.Stderr, "switch-to-configuration") && !strings.Contains(ce.Stderr, "activating the configuration") {
+		return formatChildErr(err)
+	}
+
+	return ce.withLogPath(e)
+}
@@ -0,0 +1,147 @@
+package nix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassifyCommandErr(t *testing.T) {
+	tests := []struct {
+		name     string
+		exitCode int
+		stderr   string
+		want     error
+	}{
+		{
+			name:     "nix 2.3 undefined variable",
+			exitCode: 1,
+			stderr:   "error: undefined variable 'pkgs' at /etc/nixos/configuration.nix:5:22\n",
+			want: &EvalError{
+				Message: "undefined variable 'pkgs'",
+				File:    "/etc/nixos/configuration.nix",
+				Line:    5,
+				Column:  22,
+			},
+		},
+		{
+			name:     "nix 2.3 option without trace",
+			exitCode: 1,
+			stderr: `building Nix...
+building the system configuration...
+error: The option ` + "`services.foo'" + ` does not exist. Definition values:
+- In ` + "`/etc/nixos/configuration.nix'" + `: true
+(use '--show-trace' to show detailed location information)
+`,
+			want: &EvalError{Message: "The option `services.foo' does not exist. Definition values:"},
+		},
+		{
+			name:     "nix 2.18 undefined variable",
+			exitCode: 1,
+			stderr: `error: undefined variable 'pkgs'
+
+       at /etc/nixos/configuration.nix:5:22:
+
+            4|   environment.systemPackages = [
+            5|     pkgs.hello
+             |     ^
+            6|   ];
+`,
+			want: &EvalError{
+				Message: "undefined variable 'pkgs'",
+				File:    "/etc/nixos/configuration.nix",
+				Line:    5,
+				Column:  22,
+			},
+		},
+		{
+			name:     "nix 2.18 trace",
+			exitCode: 1,
+			stderr: `error:
+       … while calling the 'head' builtin
+
+         at «string»:1:1:
+
+            1| builtins.head []
+             | ^
+
+       error: list index 0 is out of bounds
+`,
+			want: &EvalError{
+				Message: "list index 0 is out of bounds",
+				Trace:   []string{"while calling the 'head' builtin"},
+			},
+		},
+		{
+			name:     "nix 2.18 build failure",
+			exitCode: 1,
+			stderr: `error: builder for '/nix/store/0wzx0wq5jw8lf5gqahhy0hbkh3hvjfhz-hello-2.12.1.drv' failed with exit code 2;
+       last 2 log lines:
+       > make: *** [Makefile:1: all] Error 1
+       > make: *** No rule to make target 'install'.
+       For full logs, run 'nix log /nix/store/0wzx0wq5jw8lf5gqahhy0hbkh3hvjfhz-hello-2.12.1.drv'.
+`,
+			want: &BuildError{
+				Derivation: "/nix/store/0wzx0wq5jw8lf5gqahhy0hbkh3hvjfhz-hello-2.12.1.drv",
+				Message:    "exit code 2",
+				LogTail:    "make: *** [Makefile:1: all] Error 1\nmake: *** No rule to make target 'install'.",
+			},
+		},
+		{
+			name:     "nix 2.3 nix-copy-closure unreachable",
+			exitCode: 1,
+			stderr: `ssh: connect to host 10.0.0.5 port 22: Connection timed out
+error: cannot connect to 'root@10.0.0.5'
+`,
+			want: &SSHError{Host: "10.0.0.5", Message: "connect to host 10.0.0.5 port 22: Connection timed out"},
+		},
+		{
+			name:     "nix 2.18 copy unreachable",
+			exitCode: 1,
+			stderr:   "error: failed to start SSH connection to 'root@web1.example.com'\n",
+			want:     &SSHError{Host: "web1.example.com", Message: "failed to start SSH connection to 'root@web1.example.com'"},
+		},
+		{
+			name:     "nixos-rebuild permission denied",
+			exitCode: 1,
+			stderr: `building the system configuration...
+root@web1.example.com: Permission denied (publickey).
+error: cannot open connection to remote store 'ssh://root@web1.example.com': error: cannot connect to 'root@web1.example.com'
+`,
+			want: &SSHError{Message: "root@web1.example.com: Permission denied (publickey)."},
+		},
+		{
+			name:     "ssh exit status",
+			exitCode: 255,
+			stderr:   "ssh: Could not resolve hostname web1: Name or service not known\n",
+			want:     &SSHError{Host: "web1", Message: "Could not resolve hostname web1: Name or service not known"},
+		},
+		{
+			name:     "missing signature",
+			exitCode: 1,
+			stderr: `copying 1 paths...
+copying path '/nix/store/5bxjbn8h4ax7gklz6qdfbx6x8dajfmrr-hello-2.12.1' to 'ssh://root@web1.example.com'...
+error: cannot add path '/nix/store/5bxjbn8h4ax7gklz6qdfbx6x8dajfmrr-hello-2.12.1' because it lacks a signature by a trusted key
+`,
+		},
+		{
+			name:     "daemon down",
+			exitCode: 1,
+			stderr:   "error: cannot connect to socket at '/nix/var/nix/daemon-socket/socket': Connection refused\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ce := &commandError{Args: []string{"nix-build"}, ExitCode: tc.exitCode, Stderr: tc.stderr}
+			want := tc.want
+			if want == nil {
+				want = ce
+			}
+
+			got := classifyCommandErr(ce)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %T %#v\nwant %T %#v", got, got, want, want)
+			}
+		})
+	}
+}
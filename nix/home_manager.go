@@ -0,0 +1,128 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// HomeManagerConfig represents a configuration for deploying home manager for a user.
+type HomeManagerConfig struct {
+	// Target is how we connect, usually as User or root.
+	Target         SSHTarget
+	User           string
+	NixPath        string
+	ConfigPath     string
+	PreSwitchHook  string
+	PostSwitchHook string
+	Builders       Builders
+	// Log keeps the output of builds, activations and hooks, if set.
+	Log *CommandLog
+}
+
+// GetEnv returns an OS env suitable for hooks.
+func (cfg *HomeManagerConfig) GetEnv() []string {
+	env := os.Environ()
+	env = append(env, fmt.Sprintf("NIX_PATH=%s", cfg.NixPath))
+	env = append(env, fmt.Sprintf("NIX_TARGET_HOST=%s", cfg.Target.Host))
+	env = append(env, fmt.Sprintf("NIX_TARGET_USER=%s", cfg.Target.User))
+	env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s", cfg.Target.opts()))
+	env = append(env, fmt.Sprintf("HOME_MANAGER_USER=%s", cfg.User))
+	env = append(env, fmt.Sprintf("HOME_MANAGER_CONFIG=%s", cfg.ConfigPath))
+	return env
+}
+
+// asUser wraps a script so it runs as the home manager user on the target.
+func (cfg *HomeManagerConfig) asUser(script string) string {
+	if cfg.Target.User == cfg.User {
+		return script
+	}
+	return fmt.Sprintf("su -l %s -c %s", shellQuote(cfg.User), shellQuote(script))
+}
+
+// The home manager profile moved under XDG_STATE_HOME in newer releases.
+const homeManagerProfileScript = `
+profile="${XDG_STATE_HOME:-$HOME/.local/state}/nix/profiles/home-manager"
+if ! test -e "$profile"; then
+  profile="/nix/var/nix/profiles/per-user/$(id -un)/home-manager"
+fi
+`
+
+// BuildHomeManager builds the home manager activation package of the configuration.
+func BuildHomeManager(cfg *HomeManagerConfig) (string, error) {
+	opts, cleanup, err := cfg.Builders.options()
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	cmd := exec.Command("nix-build", append([]string{"--no-link", "<home-manager/home-manager/home-manager.nix>", "--argstr", "confPath", cfg.ConfigPath, "-A", "activationPackage"}, append(opts, logFormatArgs...)...)...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("NIX_PATH=%s", cfg.NixPath))
+
+	output := bytes.NewBuffer(nil)
+	err = cfg.Log.runNix(cmd, output, "build")
+	if err != nil {
+		return "", fmt.Errorf("building home manager configuration failed: %w", formatChildErr(err))
+	}
+
+	return strings.TrimSpace(output.String()), nil
+}
+
+// ActivateHomeManager runs an activation package, which is already present on the
+// target, as the user. Activation creates a new home manager generation.
+func ActivateHomeManager(cfg *HomeManagerConfig, activationPackage string) error {
+	return runWithHooks(cfg.GetEnv(), cfg.PreSwitchHook, cfg.PostSwitchHook, cfg.Log, func() error {
+		return cfg.activate(shellQuote(activationPackage + "/activate"))
+	})
+}
+
+// HomeManagerGeneration returns the activation package and generation number
+// currently active for the user, or an empty activation package if there is none.
+func HomeManagerGeneration(cfg *HomeManagerConfig) (string, int, error) {
+	output, err := cfg.Target.Run(cfg.asUser(homeManagerProfileScript + `
+if test -e "$profile"; then
+  echo "generation=$(readlink "$profile")"
+  echo "activation_package=$(readlink -f "$profile")"
+fi
+`))
+	if err != nil {
+		return "", 0, err
+	}
+
+	values := parseKeyValues(output)
+	return values["activation_package"], parseGeneration(values["generation"]), nil
+}
+
+// HomeManagerSwitchGeneration activates an existing home manager generation for the user.
+// A generation of 0 means the generation before the current one.
+func HomeManagerSwitchGeneration(cfg *HomeManagerConfig, generation int) error {
+	script := homeManagerProfileScript + fmt.Sprintf(`
+set -e
+generation=%d
+if test "$generation" -eq 0; then
+  current="$(readlink "$profile" | sed -e 's/.*-\([0-9]*\)-link$/\1/')"
+  generation="$(ls -d "$profile"-*-link | sed -e 's/.*-\([0-9]*\)-link$/\1/' | sort -n | awk -v c="$current" '$1 < c' | tail -n 1)"
+  if test -z "$generation"; then
+    echo "no previous home manager generation" >&2
+    exit 0
+  fi
+fi
+"$profile-$generation-link/activate"
+`, generation)
+
+	return runWithHooks(cfg.GetEnv(), cfg.PreSwitchHook, cfg.PostSwitchHook, cfg.Log, func() error {
+		return cfg.activate(script)
+	})
+}
+
+// activate runs an activation script as the user on the target.
+func (cfg *HomeManagerConfig) activate(script string) error {
+	err := cfg.Log.run(cfg.Target.Command(cfg.asUser(script)), ioutil.Discard, "activate")
+	if err != nil {
+		return fmt.Errorf("activating home manager for %s on %s failed: %w", cfg.User, cfg.Target.Host, formatChildErr(err))
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package nix
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type imageFormat struct {
+	// Module is imported alongside the configuration to enable the image builder.
+	Module string
+	// Attribute of config.system.build holding the image.
+	Attribute string
+	// System overrides the system to build for, if the format requires it.
+	System string
+}
+
+const diskImageModule = `({ config, lib, pkgs, modulesPath, ... }: {
+      system.build.terraformDiskImage = import "${modulesPath}/../lib/make-disk-image.nix" {
+        inherit config lib pkgs;
+        format = "%s";
+      };
+    })`
+
+var imageFormats = map[string]imageFormat{
+	"raw": {
+		Module:    fmt.Sprintf(diskImageModule, "raw"),
+		Attribute: "terraformDiskImage",
+	},
+	"qcow2": {
+		Module:    fmt.Sprintf(diskImageModule, "qcow2"),
+		Attribute: "terraformDiskImage",
+	},
+	"iso": {
+		Module:    "<nixpkgs/nixos/modules/installer/cd-dvd/iso-image.nix>",
+		Attribute: "isoImage",
+	},
+	"gce": {
+		Module:    "<nixpkgs/nixos/modules/virtualisation/google-compute-image.nix>",
+		Attribute: "googleComputeImage",
+	},
+	"amazon": {
+		Module:    "<nixpkgs/nixos/maintainers/scripts/ec2/amazon-image.nix>",
+		Attribute: "amazonImage",
+	},
+	"azure": {
+		Module:    "<nixpkgs/nixos/modules/virtualisation/azure-image.nix>",
+		Attribute: "azureImage",
+	},
+	"docker": {
+		Module:    "<nixpkgs/nixos/modules/virtualisation/docker-image.nix>",
+		Attribute: "tarball",
+	},
+	"lxc": {
+		Module:    "<nixpkgs/nixos/modules/virtualisation/lxc-container.nix>",
+		Attribute: "tarball",
+	},
+	"sd-aarch64": {
+		Module:    "<nixpkgs/nixos/modules/installer/sd-card/sd-image-aarch64.nix>",
+		Attribute: "sdImage",
+		System:    "aarch64-linux",
+	},
+}
+
+// ImageFormats returns the names of the supported image formats.
+func ImageFormats() []string {
+	formats := make([]string, 0, len(imageFormats))
+	for name := range imageFormats {
+		formats = append(formats, name)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// ImageExpression returns a nix expression building an image of the given
+// format from a nixos configuration, along with the module at
+// diskModulePath if it is not empty.
+func ImageExpression(nixosConfigPath, diskModulePath, format string) (string, error) {
+	f, ok := imageFormats[format]
+	if !ok {
+		return "", fmt.Errorf("unknown image format %q", format)
+	}
+
+	diskModule := ""
+	if diskModulePath != "" {
+		diskModule = fmt.Sprintf("%q", diskModulePath)
+	}
+
+	system := ""
+	if f.System != "" {
+		system = fmt.Sprintf("system = %q;", f.System)
+	}
+
+	return fmt.Sprintf(`let
+  nixos = import <nixpkgs/nixos> {
+    configuration = {
+      imports = [
+        %q
+        %s
+        %s
+      ];
+    };
+    %s
+  };
+in
+  nixos.config.system.build.%s
+`, nixosConfigPath, diskModule, f.Module, system, f.Attribute), nil
+}
+
+// BuildImage builds an image of a nixos configuration, returning the store path.
+// A non empty diskModule, such as the NixosModule of a DiskLayout, is imported
+// alongside the configuration.
+func BuildImage(nixPath, nixosConfigPath, diskModule, format string, outLink *string, builders Builders, cmdLog *CommandLog) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	diskModulePath := ""
+	if diskModule != "" {
+		diskModulePath = filepath.Join(tmpDir, "disk.nix")
+		err = ioutil.WriteFile(diskModulePath, []byte(diskModule), 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	expression, err := ImageExpression(nixosConfigPath, diskModulePath, format)
+	if err != nil {
+		return "", err
+	}
+
+	expressionPath := filepath.Join(tmpDir, "image.nix")
+	err = ioutil.WriteFile(expressionPath, []byte(expression), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return BuildExpression(nixPath, expressionPath, outLink, builders, Platform{}, cmdLog)
+}
+
+// FindImageFile returns the image file within an image builder output,
+// which is the largest file as the outputs may also contain metadata.
+func FindImageFile(storePath string) (string, error) {
+	imagePath := ""
+	imageSize := int64(-1)
+
+	err := filepath.Walk(storePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "nix-support" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && info.Size() > imageSize {
+			imagePath = path
+			imageSize = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if imagePath == "" {
+		return "", fmt.Errorf("no image file found in %s", storePath)
+	}
+
+	return imagePath, nil
+}
+
+// FileSHA256 returns the hex encoded sha256 of a file.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,234 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Install methods supported by Install.
+const (
+	// InstallMethodKexec downloads a nixos installer onto the target, kexecs
+	// into it and installs from there.
+	InstallMethodKexec = "kexec"
+	// InstallMethodInstaller assumes the target is already running a nixos installer.
+	InstallMethodInstaller = "installer"
+	// InstallMethodLustrate converts the running system in place with NIXOS_LUSTRATE,
+	// the target must already have nix installed.
+	InstallMethodLustrate = "lustrate"
+)
+
+// DefaultKexecURL is a kexec tarball from the nixos-images project.
+const DefaultKexecURL = "https://github.com/nix-community/nixos-images/releases/download/nixos-unstable/nixos-kexec-installer-noninteractive-x86_64-linux.tar.gz"
+
+// InstallConfig represents a configuration for installing nixos on a host.
+type InstallConfig struct {
+	TargetHost      string
+	TargetUser      string
+	SSHOpts         string
+	SSHTimeout      time.Duration
+	NixPath         string
+	NixosConfigPath string
+	Method          string
+	KexecURL        string
+	PartitionScript string
+	Reboot          bool
+	Builders        Builders
+	// Log keeps the output of the build and each install step, if set.
+	Log *CommandLog
+}
+
+// BuildNixosSystem builds the system of a nixos configuration locally and
+// returns the store path.
+func BuildNixosSystem(nixPath, nixosConfigPath string, builders Builders, cmdLog *CommandLog) (string, error) {
+	opts, cleanup, err := builders.options()
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	cmd := exec.Command("nix-build", append([]string{"--no-link", "<nixpkgs/nixos>", "-A", "system"}, append(opts, logFormatArgs...)...)...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("NIX_PATH=%s", nixPath), fmt.Sprintf("NIXOS_CONFIG=%s", nixosConfigPath))
+
+	output := bytes.NewBuffer(nil)
+	err = cmdLog.runNix(cmd, output, "build")
+	if err != nil {
+		return "", fmt.Errorf("building system failed: %w", formatChildErr(err))
+	}
+
+	return strings.TrimSpace(output.String()), nil
+}
+
+func (cfg *InstallConfig) run(script string) error {
+	cmd := sshCommand(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, script)
+	err := runCommandWithLogging(cmd, ioutil.Discard)
+	return formatChildErr(err)
+}
+
+// runStep is run for the steps of the install, keeping their output in cfg.Log.
+func (cfg *InstallConfig) runStep(name, script string) error {
+	cmd := sshCommand(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, script)
+	err := cfg.Log.run(cmd, ioutil.Discard, name)
+	return formatChildErr(err)
+}
+
+// partition runs the partition script fed to the shell on stdin, which keeps
+// secrets in it, such as luks passphrases, out of process arguments.
+func (cfg *InstallConfig) partition() error {
+	cmd := sshCommand(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, "sh -s")
+	cmd.Stdin = strings.NewReader(cfg.PartitionScript)
+	err := cfg.Log.run(cmd, ioutil.Discard, "partition")
+	return formatChildErr(err)
+}
+
+func (cfg *InstallConfig) copyClosure(storePath, remoteStore string) error {
+	cmd := exec.Command("nix", "--extra-experimental-features", "nix-command", "copy", "--no-check-sigs", "--to", fmt.Sprintf("ssh://%s@%s%s", cfg.TargetUser, cfg.TargetHost, remoteStore), storePath)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("NIX_SSHOPTS=%s", cfg.SSHOpts))
+	err := cfg.Log.run(cmd, ioutil.Discard, "copy")
+	if err != nil {
+		return fmt.Errorf("copying closure failed: %w", formatChildErr(err))
+	}
+	return nil
+}
+
+// waitForInstaller waits until the target is running nixos, which is how we
+// know a kexec has completed.
+func (cfg *InstallConfig) waitForInstaller() error {
+	deadline := time.Now().Add(cfg.SSHTimeout)
+	for {
+		err := cfg.run("grep -q '^ID=nixos' /etc/os-release")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for the nixos installer to boot")
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (cfg *InstallConfig) reboot() error {
+	// Detach so ssh returns before the connection is torn down.
+	err := cfg.run("nohup sh -c 'sleep 2 && reboot' >/dev/null 2>&1 &")
+	if err != nil {
+		return err
+	}
+	time.Sleep(15 * time.Second)
+	return WaitForSSH(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.SSHTimeout)
+}
+
+// validate checks the install can be attempted, before anything is done to the target.
+func (cfg *InstallConfig) validate() error {
+	switch cfg.Method {
+	case InstallMethodKexec, InstallMethodInstaller:
+		if cfg.PartitionScript == "" {
+			return errors.New("a partition script is required to install onto a fresh host")
+		}
+	case InstallMethodLustrate:
+	default:
+		return fmt.Errorf("unknown install method %q", cfg.Method)
+	}
+	return nil
+}
+
+// kexecScript downloads a kexec installer tarball and boots into it.
+func kexecScript(kexecURL string) string {
+	if kexecURL == "" {
+		kexecURL = DefaultKexecURL
+	}
+	return fmt.Sprintf(`set -e
+mkdir -p /root/kexec-installer
+cd /root/kexec-installer
+(curl -fsSL %s || wget -qO- %s) | tar -xzf-
+./kexec/run
+`, shellQuote(kexecURL), shellQuote(kexecURL))
+}
+
+// installScript installs system onto the filesystems mounted at /mnt.
+func installScript(system string) string {
+	return fmt.Sprintf("nixos-install --no-root-passwd --no-channel-copy --system %s", shellQuote(system))
+}
+
+// lustrateScript makes system the boot configuration of a running linux
+// host, replacing the old root filesystem on the next boot.
+func lustrateScript(system string) string {
+	return fmt.Sprintf(`set -e
+nix-env -p %s --set %s
+touch /etc/NIXOS
+echo etc/nixos > /etc/NIXOS_LUSTRATE
+%s/bin/switch-to-configuration boot
+`, systemProfile, shellQuote(system), systemProfile)
+}
+
+// Install installs nixos onto the target host, returning the installed system.
+func Install(cfg *InstallConfig) (string, error) {
+	err := cfg.validate()
+	if err != nil {
+		return "", err
+	}
+
+	system, err := BuildNixosSystem(cfg.NixPath, cfg.NixosConfigPath, cfg.Builders, cfg.Log)
+	if err != nil {
+		return "", err
+	}
+
+	err = WaitForSSH(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.SSHTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	switch cfg.Method {
+	case InstallMethodKexec, InstallMethodInstaller:
+		if cfg.Method == InstallMethodKexec {
+			err = cfg.runStep("kexec", kexecScript(cfg.KexecURL))
+			if err != nil {
+				return "", fmt.Errorf("starting kexec installer failed: %s", err)
+			}
+			err = cfg.waitForInstaller()
+			if err != nil {
+				return "", err
+			}
+		}
+
+		err = cfg.partition()
+		if err != nil {
+			return "", fmt.Errorf("partitioning failed: %s", err)
+		}
+
+		err = cfg.copyClosure(system, "?remote-store=local?root=/mnt")
+		if err != nil {
+			return "", err
+		}
+
+		err = cfg.runStep("install", installScript(system))
+		if err != nil {
+			return "", fmt.Errorf("nixos-install failed: %s", err)
+		}
+	case InstallMethodLustrate:
+		err = cfg.copyClosure(system, "")
+		if err != nil {
+			return "", err
+		}
+
+		err = cfg.runStep("lustrate", lustrateScript(system))
+		if err != nil {
+			return "", fmt.Errorf("converting system in place failed: %s", err)
+		}
+	default:
+		return "", fmt.Errorf("unknown install method %q", cfg.Method)
+	}
+
+	if cfg.Reboot {
+		err = cfg.reboot()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return system, nil
+}
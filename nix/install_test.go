@@ -0,0 +1,229 @@
+package nix
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstallConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     InstallConfig
+		wantErr string
+	}{
+		{"kexec", InstallConfig{Method: InstallMethodKexec, PartitionScript: "true"}, ""},
+		{"installer", InstallConfig{Method: InstallMethodInstaller, PartitionScript: "true"}, ""},
+		{"lustrate without partitioning", InstallConfig{Method: InstallMethodLustrate}, ""},
+		{"kexec without partitioning", InstallConfig{Method: InstallMethodKexec}, "partition script is required"},
+		{"installer without partitioning", InstallConfig{Method: InstallMethodInstaller}, "partition script is required"},
+		{"unknown method", InstallConfig{Method: "pxe", PartitionScript: "true"}, `unknown install method "pxe"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestInstallScripts checks the scripts run their steps in order, and runs
+// the lines that take a value against fake commands to check the value
+// reaches them as a single argument.
+func TestInstallScripts(t *testing.T) {
+	const kexecURL = "https://example.com/it's a kexec.tar.gz"
+	const system = "/nix/store/abc-nixos-system-host 20.09's"
+
+	dir, err := ioutil.TempDir("", "install-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"curl", "wget", "nixos-install", "nix-env"} {
+		fakeCommand(t, name, `printf '%s\n' "$@" > '`+filepath.Join(dir, name)+"'\n")
+	}
+	fakeCommand(t, "tar", "cat > /dev/null\n")
+
+	tests := []struct {
+		name   string
+		script string
+		steps  []string
+		run    string
+		want   map[string][]string
+	}{
+		{
+			name:   "kexec",
+			script: kexecScript(kexecURL),
+			steps:  []string{"set -e", "mkdir -p /root/kexec-installer", "cd /root/kexec-installer", "(curl", "./kexec/run"},
+			run:    "(curl",
+			want:   map[string][]string{"curl": {"-fsSL", kexecURL}},
+		},
+		{
+			name:   "kexec default url",
+			script: kexecScript(""),
+			steps:  []string{"set -e", "mkdir -p /root/kexec-installer", "cd /root/kexec-installer", "(curl", "./kexec/run"},
+			run:    "(curl",
+			want:   map[string][]string{"curl": {"-fsSL", DefaultKexecURL}},
+		},
+		{
+			name:   "install",
+			script: installScript(system),
+			steps:  []string{"nixos-install"},
+			run:    "nixos-install",
+			want:   map[string][]string{"nixos-install": {"--no-root-passwd", "--no-channel-copy", "--system", system}},
+		},
+		{
+			name:   "lustrate",
+			script: lustrateScript(system),
+			steps:  []string{"set -e", "nix-env", "touch /etc/NIXOS", "echo etc/nixos > /etc/NIXOS_LUSTRATE", systemProfile + "/bin/switch-to-configuration boot"},
+			run:    "nix-env",
+			want:   map[string][]string{"nix-env": {"-p", systemProfile, "--set", system}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lines := strings.Split(strings.TrimSpace(tc.script), "\n")
+			if len(lines) != len(tc.steps) {
+				t.Fatalf("got script:\n%s\nwant %d steps", tc.script, len(tc.steps))
+			}
+			run := ""
+			for i, step := range tc.steps {
+				if !strings.HasPrefix(lines[i], step) {
+					t.Fatalf("got step %d %q, want %q", i, lines[i], step)
+				}
+				if step == tc.run {
+					run = lines[i]
+				}
+			}
+
+			for name := range tc.want {
+				os.Remove(filepath.Join(dir, name))
+			}
+			out, err := exec.Command("sh", "-c", run).CombinedOutput()
+			if err != nil {
+				t.Fatalf("running %q failed: %s: %s", run, err, out)
+			}
+			for name, want := range tc.want {
+				b, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s got arguments %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestInstallPartitionStdin checks the partition script, which may hold luks
+// passphrases, reaches the target on stdin rather than as an argument.
+func TestInstallPartitionStdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "install-stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := filepath.Join(dir, "args")
+	stdin := filepath.Join(dir, "stdin")
+	fakeCommand(t, "ssh", `printf '%s\n' "$@" > '`+args+`'
+cat > '`+stdin+`'
+`)
+
+	const script = "printf '%s' 'secret' > \"$keyfile\"\n"
+	cfg := &InstallConfig{TargetHost: "web1.example.com", TargetUser: "root", PartitionScript: script}
+	err = cfg.partition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Fatalf("ssh got the script in its arguments %q", b)
+	}
+
+	b, err = ioutil.ReadFile(stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != script {
+		t.Fatalf("ssh got stdin %q, want %q", b, script)
+	}
+}
+
+// TestInstallAcceptance installs onto a disposable machine, such as a QEMU vm
+// booted from a nixos installer iso with ssh forwarded to the host. It wipes
+// the machine, so it only runs when NIX_INSTALL_TEST_HOST is set:
+//
+//	NIX_INSTALL_TEST_HOST=localhost
+//	NIX_INSTALL_TEST_SSHOPTS="-p 2222 -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
+//	NIX_INSTALL_TEST_CONFIG=/path/to/configuration.nix
+//	NIX_INSTALL_TEST_PARTITION_SCRIPT=/path/to/partition.sh
+//	NIX_INSTALL_TEST_METHOD=installer
+func TestInstallAcceptance(t *testing.T) {
+	host := os.Getenv("NIX_INSTALL_TEST_HOST")
+	if host == "" {
+		t.Skip("NIX_INSTALL_TEST_HOST is not set")
+	}
+
+	method := os.Getenv("NIX_INSTALL_TEST_METHOD")
+	if method == "" {
+		method = InstallMethodInstaller
+	}
+
+	partitionScript := ""
+	if path := os.Getenv("NIX_INSTALL_TEST_PARTITION_SCRIPT"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partitionScript = string(b)
+	}
+
+	cfg := &InstallConfig{
+		TargetHost:      host,
+		TargetUser:      "root",
+		SSHOpts:         os.Getenv("NIX_INSTALL_TEST_SSHOPTS"),
+		SSHTimeout:      10 * time.Minute,
+		NixPath:         os.Getenv("NIX_PATH"),
+		NixosConfigPath: os.Getenv("NIX_INSTALL_TEST_CONFIG"),
+		Method:          method,
+		PartitionScript: partitionScript,
+		Reboot:          true,
+	}
+
+	system, err := Install(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := runOn(&SSHTarget{User: cfg.TargetUser, Host: cfg.TargetHost, SSHOpts: cfg.SSHOpts}, "readlink -f /run/current-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if current != system {
+		t.Fatalf("booted %s, want the installed %s", current, system)
+	}
+}
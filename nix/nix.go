@@ -5,27 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
-func formatChildErr(err error) error {
-	if err == nil {
-		return nil
-	}
-
-	if err, ok := err.(*exec.ExitError); ok {
-		return errors.New(string(err.Stderr))
-	}
-	return err
-}
-
-// BuildExpression builds a nix expression, returning the store path.
-func BuildExpression(nixPath string, expressionPath string, outLink *string) (string, error) {
+// BuildExpression builds a nix expression for platform, returning the store path.
+// The output of the build is kept in cmdLog, which may be nil.
+func BuildExpression(nixPath string, expressionPath string, outLink *string, builders Builders, platform Platform, cmdLog *CommandLog) (string, error) {
 
 	tempDir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -33,20 +27,27 @@ func BuildExpression(nixPath string, expressionPath string, outLink *string) (st
 	}
 	defer os.RemoveAll(tempDir)
 
+	opts, cleanup, err := platform.buildOptions(builders)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	opts = append(append(opts, platform.expressionArgs()...), logFormatArgs...)
+
 	var cmd *exec.Cmd
 
 	if outLink == nil {
-		cmd = exec.Command("nix-build", "--no-link", expressionPath)
+		cmd = exec.Command("nix-build", append([]string{"--no-link", expressionPath}, opts...)...)
 	} else {
-		cmd = exec.Command("nix-build", "-o", *outLink, expressionPath)
+		cmd = exec.Command("nix-build", append([]string{"-o", *outLink, expressionPath}, opts...)...)
 	}
 
 	cmd.Env = []string{fmt.Sprintf("NIX_PATH=%s", nixPath)}
 
 	output := bytes.NewBuffer(nil)
-	err = runCommandWithLogging(cmd, output)
+	err = cmdLog.runNix(cmd, output, "build")
 	if err != nil {
-		return "", fmt.Errorf("building expression failed: %s", formatChildErr(err))
+		return "", fmt.Errorf("building expression failed: %w", formatChildErr(err))
 	}
 
 	if outLink == nil {
@@ -56,16 +57,158 @@ func BuildExpression(nixPath string, expressionPath string, outLink *string) (st
 	}
 }
 
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*[a-zA-Z]")
+
+// Kinds of ClosureChange.
+const (
+	ClosureAdded    = "added"
+	ClosureRemoved  = "removed"
+	ClosureUpgraded = "upgraded"
+	// ClosureResized is a package whose versions are unchanged, but whose size is not.
+	ClosureResized = "resized"
+)
+
+// ClosureChange is how a package differs between two closures.
+type ClosureChange struct {
+	Name   string
+	Change string
+	// OldVersions and NewVersions are the versions of the package in each
+	// closure, comma separated when there are several. They are empty for
+	// added and removed packages, and for packages without a version.
+	OldVersions string
+	NewVersions string
+	// SizeDelta is the change in the size of the package, in bytes.
+	SizeDelta int64
+}
+
+// DiffClosures returns the package level differences between the closures of
+// two store paths, as computed by nix store diff-closures. Both paths must
+// be valid in the local store.
+func DiffClosures(before, after string) ([]ClosureChange, error) {
+	cmd := exec.Command("nix", "--extra-experimental-features", "nix-command", "store", "diff-closures", before, after)
+
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(cmd, output)
+	if err != nil {
+		return nil, fmt.Errorf("diffing closures failed: %w", formatChildErr(err))
+	}
+
+	return parseClosureDiff(output.String())
+}
+
+var closureSizeDelta = regexp.MustCompile(`(?:^|,\s*)([+-][0-9.]+) KiB$`)
+
+// parseClosureDiff parses the output of nix store diff-closures, lines such as
+// "glibc: 2.32-46 → 2.33-47, +1234.5 KiB". ∅ is a package missing from one of
+// the closures and ε a package without a version.
+func parseClosureDiff(output string) ([]ClosureChange, error) {
+	changes := []ClosureChange{}
+
+	for _, line := range strings.Split(ansiEscape.ReplaceAllString(output, ""), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		idx := strings.Index(line, ": ")
+		if idx < 0 {
+			return nil, fmt.Errorf("unexpected closure diff line %q", line)
+		}
+		c := ClosureChange{Name: line[:idx], Change: ClosureResized}
+		rest := line[idx+2:]
+
+		if m := closureSizeDelta.FindStringSubmatchIndex(rest); m != nil {
+			kib, err := strconv.ParseFloat(rest[m[2]:m[3]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected closure diff line %q", line)
+			}
+			c.SizeDelta = int64(math.Round(kib * 1024))
+			rest = rest[:m[0]]
+		}
+
+		if rest != "" {
+			versions := strings.SplitN(rest, " → ", 2)
+			if len(versions) != 2 {
+				return nil, fmt.Errorf("unexpected closure diff line %q", line)
+			}
+			c.OldVersions = closureVersions(versions[0])
+			c.NewVersions = closureVersions(versions[1])
+			switch {
+			case versions[0] == "∅":
+				c.Change = ClosureAdded
+			case versions[1] == "∅":
+				c.Change = ClosureRemoved
+			default:
+				c.Change = ClosureUpgraded
+			}
+		}
+
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+func closureVersions(s string) string {
+	if s == "∅" {
+		return ""
+	}
+	return strings.Replace(s, "ε", "", -1)
+}
+
 // NixosRebuildConfig represents a configuration for Nixos rebuild.
 type NixosRebuildConfig struct {
-	TargetHost     string
-	TargetUser     string
-	BuildHost      string
-	NixosConfigPath    string
-	NixPath        string
-	SSHOpts        string
-	PreSwitchHook  string
-	PostSwitchHook string
+	TargetHost string
+	TargetUser string
+	// BuildHost builds the system remotely if set.
+	BuildHost       *BuildHost
+	NixosConfigPath string
+	NixPath         string
+	SSHOpts         string
+	PreSwitchHook   string
+	PostSwitchHook  string
+	// Transport is how the TargetHost is reached, ssh if empty.
+	Transport string
+	// Builders may be offloaded to when building locally.
+	Builders Builders
+	// Platform is what the system is built for.
+	Platform Platform
+	// UseSudo elevates activation, profile changes and garbage collection
+	// for a TargetUser other than root.
+	UseSudo      bool
+	SudoPassword string
+	// Log keeps the output of builds, switches and hooks, if set.
+	Log *CommandLog
+	// SSHTimeout bounds connecting to the TargetHost over ssh, if set.
+	SSHTimeout time.Duration
+}
+
+// Target returns the transport to the TargetHost.
+func (cfg *NixosRebuildConfig) Target() (Transport, error) {
+	kind := cfg.Transport
+	if kind == "" {
+		kind = TransportSSH
+	}
+
+	target, err := NewTransport(kind, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts)
+	if ssh, ok := target.(*SSHTarget); ok {
+		ssh.ConnectTimeout = cfg.SSHTimeout
+	}
+	return target, err
+}
+
+// ElevatedTarget returns the transport to the TargetHost for commands that need root.
+func (cfg *NixosRebuildConfig) ElevatedTarget() (Transport, error) {
+	target, err := cfg.Target()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.UseSudo {
+		return &SudoTarget{Transport: target, Password: cfg.SudoPassword}, nil
+	}
+
+	return target, nil
 }
 
 // GetEnv returns an OS env suitable for nixos-rebuild.
@@ -74,7 +217,7 @@ func (cfg *NixosRebuildConfig) GetEnv() []string {
 	env = append(env, fmt.Sprintf("NIX_PATH=%s", cfg.NixPath))
 	env = append(env, fmt.Sprintf("NIX_TARGET_HOST=%s", cfg.TargetHost))
 	env = append(env, fmt.Sprintf("NIX_TARGET_USER=%s", cfg.TargetUser))
-	env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s", cfg.SSHOpts))
+	env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s", withConnectTimeout(cfg.SSHOpts, cfg.SSHTimeout)))
 	env = append(env, fmt.Sprintf("NIXOS_CONFIG=%s", cfg.NixosConfigPath))
 	return env
 }
@@ -113,7 +256,7 @@ func WaitForSSH(user, host, sshOpts string, timeout time.Duration) error {
 		dialer := net.Dialer{
 			Timeout: 10 * time.Second,
 		}
-		c, err := dialer.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
+		c, err := dialer.Dial("tcp", net.JoinHostPort(host, port))
 		if err == nil {
 			_ = c.Close()
 			break
@@ -131,7 +274,22 @@ func WaitForSSH(user, host, sshOpts string, timeout time.Duration) error {
 }
 
 // BuildSystem builds a nixos system config and returns the store path.
+// With a BuildHost, the system is left on the build host.
 func BuildSystem(cfg *NixosRebuildConfig) (string, error) {
+	nixosConfig, cleanupConfig, err := cfg.Platform.nixosConfig(cfg.NixosConfigPath)
+	if err != nil {
+		return "", err
+	}
+	defer cleanupConfig()
+
+	if cfg.BuildHost != nil {
+		drvPath, err := cfg.BuildHost.Instantiate(cfg.NixPath, []string{fmt.Sprintf("NIXOS_CONFIG=%s", nixosConfig)}, "<nixpkgs/nixos>", "-A", "system")
+		if err != nil {
+			return "", err
+		}
+		return cfg.BuildHost.Build(drvPath, cfg.Log)
+	}
+
 	tmp, err := ioutil.TempDir("", "")
 	if err != nil {
 		return "", err
@@ -144,10 +302,16 @@ func BuildSystem(cfg *NixosRebuildConfig) (string, error) {
 		return "", err
 	}
 
-	cmd := exec.Command("nixos-rebuild", "build", "--build-host", cfg.BuildHost)
+	opts, cleanup, err := cfg.Platform.buildOptions(cfg.Builders)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	cmd := exec.Command("nixos-rebuild", append(append([]string{"build"}, opts...), logFormatArgs...)...)
 	cmd.Dir = tmp
-	cmd.Env = cfg.GetEnv()
-	err = runCommandWithLogging(cmd, ioutil.Discard)
+	cmd.Env = append(cfg.GetEnv(), fmt.Sprintf("NIXOS_CONFIG=%s", nixosConfig))
+	err = cfg.Log.runNix(cmd, ioutil.Discard, "build")
 	if err != nil {
 		return "", formatChildErr(err)
 	}
@@ -157,25 +321,173 @@ func BuildSystem(cfg *NixosRebuildConfig) (string, error) {
 
 // CurrentSystem returns the store path of the system on the TargetHost.
 func CurrentSystem(cfg *NixosRebuildConfig) (string, error) {
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("exec timeout 10s ssh %s %s@%s -- readlink /run/current-system", cfg.SSHOpts, cfg.TargetUser, cfg.TargetHost))
+	target, err := cfg.ElevatedTarget()
+	if err != nil {
+		return "", err
+	}
+
+	return runOn(target, "readlink /run/current-system")
+}
+
+// SystemInfo describes the deployed state of a nixos host.
+type SystemInfo struct {
+	CurrentSystem string
+	BootedSystem  string
+	Generation    int
+	NixosVersion  string
+	KernelVersion string
+}
+
+const systemInfoScript = `
+echo "current_system=$(readlink /run/current-system)"
+echo "booted_system=$(readlink /run/booted-system)"
+echo "system_profile=$(readlink /nix/var/nix/profiles/system)"
+echo "nixos_version=$(nixos-version 2>/dev/null)"
+echo "kernel_version=$(uname -r)"
+`
+
+var generationLink = regexp.MustCompile(`-([0-9]+)-link$`)
+
+// parseGeneration extracts the generation number from a profile link such as system-42-link.
+func parseGeneration(link string) int {
+	m := generationLink.FindStringSubmatch(filepath.Base(link))
+	if m == nil {
+		return 0
+	}
+	generation, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0
+	}
+	return generation
+}
+
+func parseSystemInfo(values map[string]string) SystemInfo {
+	return SystemInfo{
+		CurrentSystem: values["current_system"],
+		BootedSystem:  values["booted_system"],
+		Generation:    parseGeneration(values["system_profile"]),
+		NixosVersion:  values["nixos_version"],
+		KernelVersion: values["kernel_version"],
+	}
+}
+
+// GetSystemInfo returns information about the system deployed on the TargetHost.
+func GetSystemInfo(cfg *NixosRebuildConfig) (SystemInfo, error) {
+	target, err := cfg.ElevatedTarget()
+	if err != nil {
+		return SystemInfo{}, err
+	}
+
+	output := bytes.NewBuffer(nil)
+	err = runCommandWithLogging(target.Command(systemInfoScript), output)
+	if err != nil {
+		return SystemInfo{}, fmt.Errorf("querying system info failed: %w", formatChildErr(err))
+	}
+
+	return parseSystemInfo(parseKeyValues(output.String())), nil
+}
+
+// MachineID returns the contents of /etc/machine-id on the target.
+func MachineID(target Transport) (string, error) {
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(target.Command("cat /etc/machine-id"), output)
+	if err != nil {
+		return "", fmt.Errorf("reading machine id failed: %w", formatChildErr(err))
+	}
+
+	return strings.TrimSpace(output.String()), nil
+}
+
+// Generation is a generation of the nixos system profile.
+type Generation struct {
+	Number int
+	System string
+}
+
+// HostInfo describes a nixos host for inventory purposes.
+type HostInfo struct {
+	SystemInfo
+	Generations  []Generation
+	Architecture string
+	NixFreeBytes int64
+	FailedUnits  []string
+	MachineID    string
+}
+
+const hostInfoScript = `
+echo "architecture=$(uname -m)"
+echo "machine_id=$(cat /etc/machine-id)"
+echo "nix_free_bytes=$(df -P -B1 /nix | awk 'NR==2 {print $4}')"
+echo "failed_units=$(systemctl list-units --failed --plain --no-legend | awk '{print $1}' | tr '\n' ' ')"
+for link in /nix/var/nix/profiles/system-*-link; do
+  if test -e "$link"; then
+    echo "generation $(basename "$link")=$(readlink "$link")"
+  fi
+done
+`
+
+// GetHostInfo returns information about the nixos host at user@host.
+func GetHostInfo(user, host, sshOpts string) (HostInfo, error) {
+	cmd := sshCommand(user, host, sshOpts, systemInfoScript+hostInfoScript)
 
 	output := bytes.NewBuffer(nil)
 	err := runCommandWithLogging(cmd, output)
-	return strings.TrimSpace(output.String()), formatChildErr(err)
+	if err != nil {
+		return HostInfo{}, fmt.Errorf("querying host info failed: %w", formatChildErr(err))
+	}
+
+	values := parseKeyValues(output.String())
+
+	info := HostInfo{
+		SystemInfo:   parseSystemInfo(values),
+		Generations:  []Generation{},
+		Architecture: values["architecture"],
+		FailedUnits:  strings.Fields(values["failed_units"]),
+		MachineID:    values["machine_id"],
+	}
+
+	if values["nix_free_bytes"] != "" {
+		info.NixFreeBytes, err = strconv.ParseInt(values["nix_free_bytes"], 10, 64)
+		if err != nil {
+			return HostInfo{}, fmt.Errorf("unable to parse free space on /nix: %s", err)
+		}
+	}
+
+	for k, v := range values {
+		if !strings.HasPrefix(k, "generation ") {
+			continue
+		}
+		number := parseGeneration(strings.TrimPrefix(k, "generation "))
+		if number == 0 {
+			continue
+		}
+		info.Generations = append(info.Generations, Generation{Number: number, System: v})
+	}
+
+	sort.Slice(info.Generations, func(i, j int) bool {
+		return info.Generations[i].Number < info.Generations[j].Number
+	})
+
+	return info, nil
 }
 
-// SwitchSystem is the equivalent of nixos-rebuild switch.
-func SwitchSystem(cfg *NixosRebuildConfig) error {
+// withSwitchHooks runs the configured pre and post switch hooks around switch.
+func withSwitchHooks(cfg *NixosRebuildConfig, doSwitch func() error) error {
+	return runWithHooks(cfg.GetEnv(), cfg.PreSwitchHook, cfg.PostSwitchHook, cfg.Log, doSwitch)
+}
+
+// runWithHooks runs local hook scripts in env before and after doSwitch,
+// keeping their output in cmdLog, which may be nil.
+func runWithHooks(env []string, preHook, postHook string, cmdLog *CommandLog, doSwitch func() error) error {
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(tmpDir)
 
-	env := cfg.GetEnv()
 	hookPath := filepath.Join(tmpDir, "hook")
 
-	runHook := func(hookText string) error {
+	runHook := func(name, hookText string) error {
 		if hookText == "" {
 			return nil
 		}
@@ -188,33 +500,157 @@ func SwitchSystem(cfg *NixosRebuildConfig) error {
 		hook := exec.Command(hookPath)
 		hook.Env = env
 
-		err = runCommandWithLogging(hook, ioutil.Discard)
+		err = cmdLog.run(hook, ioutil.Discard, name)
 		return err
 	}
 
-	err = runHook(cfg.PreSwitchHook)
+	err = runHook("pre-switch-hook", preHook)
 	if err != nil {
 		return formatChildErr(err)
 	}
 
-	cmd := exec.Command("nixos-rebuild", "switch", "--build-host", cfg.BuildHost, "--target-host", fmt.Sprintf("%s@%s", cfg.TargetUser, cfg.TargetHost))
-	cmd.Env = env
-	err = runCommandWithLogging(cmd, ioutil.Discard)
+	err = doSwitch()
 	if err != nil {
-		return formatChildErr(err)
+		return err
 	}
 
-	err = runHook(cfg.PostSwitchHook)
+	err = runHook("post-switch-hook", postHook)
 	if err != nil {
 		return formatChildErr(err)
 	}
 
-	return err
+	return nil
+}
+
+// SwitchSystem is the equivalent of nixos-rebuild switch. Transports other
+// than ssh, sudo passwords and build host connection settings are not
+// supported by nixos-rebuild, so for those the system is built here, copied
+// to the target and activated.
+func SwitchSystem(cfg *NixosRebuildConfig) error {
+	if (cfg.Transport != "" && cfg.Transport != TransportSSH) || cfg.SudoPassword != "" || cfg.BuildHost != nil {
+		target, err := cfg.Target()
+		if err != nil {
+			return err
+		}
+
+		systemPath, err := BuildSystem(cfg)
+		if err != nil {
+			return err
+		}
+
+		err = copySystem(cfg, target, systemPath)
+		if err != nil {
+			return err
+		}
+
+		return SwitchToSystem(cfg, systemPath)
+	}
+
+	return withSwitchHooks(cfg, func() error {
+		args := []string{"switch", "--target-host", fmt.Sprintf("%s@%s", cfg.TargetUser, cfg.TargetHost)}
+		if cfg.UseSudo {
+			args = append(args, "--use-remote-sudo")
+		}
+
+		nixosConfig, cleanupConfig, err := cfg.Platform.nixosConfig(cfg.NixosConfigPath)
+		if err != nil {
+			return err
+		}
+		defer cleanupConfig()
+
+		opts, cleanup, err := cfg.Platform.buildOptions(cfg.Builders)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		cmd := exec.Command("nixos-rebuild", append(append(args, opts...), logFormatArgs...)...)
+		cmd.Env = append(cfg.GetEnv(), fmt.Sprintf("NIXOS_CONFIG=%s", nixosConfig))
+		err = cfg.Log.runNix(cmd, ioutil.Discard, "switch")
+		return activationErr(cfg.TargetHost, err)
+	})
+}
+
+// copySystem copies a system built by BuildSystem to the target. Systems are
+// copied from a build host directly to ssh targets, other targets can only be
+// reached through us.
+func copySystem(cfg *NixosRebuildConfig, target Transport, systemPath string) error {
+	if cfg.BuildHost == nil {
+		return CopyToTarget(target, systemPath)
+	}
+
+	if ssh, ok := target.(*SSHTarget); ok {
+		return cfg.BuildHost.CopyTo(ssh, systemPath)
+	}
+
+	err := cfg.BuildHost.Fetch(systemPath)
+	if err != nil {
+		return err
+	}
+	return CopyToTarget(target, systemPath)
+}
+
+const systemProfile = "/nix/var/nix/profiles/system"
+
+// ResolveGeneration returns the system store path of an existing generation on the TargetHost.
+func ResolveGeneration(cfg *NixosRebuildConfig, generation int) (string, error) {
+	target, err := cfg.Target()
+	if err != nil {
+		return "", err
+	}
+
+	script := fmt.Sprintf("readlink -e %s-%d-link", systemProfile, generation)
+
+	output := bytes.NewBuffer(nil)
+	err = runCommandWithLogging(target.Command(script), output)
+	if err != nil {
+		return "", fmt.Errorf("generation %d not found on %s: %w", generation, cfg.TargetHost, formatChildErr(err))
+	}
+
+	return strings.TrimSpace(output.String()), nil
+}
+
+// SwitchGeneration switches the TargetHost to an existing generation of the system profile
+// without building anything, the equivalent of nixos-rebuild switch --rollback.
+func SwitchGeneration(cfg *NixosRebuildConfig, generation int) error {
+	script := fmt.Sprintf(`set -e
+nix-env -p %s --switch-generation %d
+%s/bin/switch-to-configuration switch
+`, systemProfile, generation, systemProfile)
+
+	target, err := cfg.ElevatedTarget()
+	if err != nil {
+		return err
+	}
+
+	return withSwitchHooks(cfg, func() error {
+		err := cfg.Log.run(target.Command(script), ioutil.Discard, "switch")
+		return activationErr(cfg.TargetHost, err)
+	})
+}
+
+// SwitchToSystem switches the TargetHost to a system store path that is already
+// present in its store, without building anything.
+func SwitchToSystem(cfg *NixosRebuildConfig, systemPath string) error {
+	script := fmt.Sprintf(`set -e
+nix-store --check-validity %s
+nix-env -p %s --set %s
+%s/bin/switch-to-configuration switch
+`, shellQuote(systemPath), systemProfile, shellQuote(systemPath), shellQuote(systemPath))
+
+	target, err := cfg.ElevatedTarget()
+	if err != nil {
+		return err
+	}
+
+	return withSwitchHooks(cfg, func() error {
+		err := cfg.Log.run(target.Command(script), ioutil.Discard, "switch")
+		return activationErr(cfg.TargetHost, err)
+	})
 }
 
-// CollectGarbage runs nix-collect-garbage -d on the remote host.
-func CollectGarbage(user, host, sshOpts string) error {
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("exec ssh %s %s@%s -- nix-collect-garbage -d", sshOpts, user, host))
-	err := runCommandWithLogging(cmd, ioutil.Discard)
+// CollectGarbage runs nix-collect-garbage -d on the target.
+func CollectGarbage(target Transport) error {
+	err := runCommandWithLogging(target.Command("nix-collect-garbage -d"), ioutil.Discard)
 	return formatChildErr(err)
 }
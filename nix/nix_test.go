@@ -0,0 +1,37 @@
+package nix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseClosureDiff(t *testing.T) {
+	output := "\x1b[1mglibc\x1b[0m: 2.32-46 → 2.33-47, \x1b[31;1m+1234.5 KiB\x1b[0m\n" +
+		"hello: ∅ → 2.10, +200.0 KiB\n" +
+		"nano: 5.4 → ∅, -2048.0 KiB\n" +
+		"firefox: 90.0, 91.0 → 92.0\n" +
+		"source: ε → 1.0\n" +
+		"nixos-system-web1: -12.3 KiB\n"
+
+	changes, err := parseClosureDiff(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ClosureChange{
+		{Name: "glibc", Change: ClosureUpgraded, OldVersions: "2.32-46", NewVersions: "2.33-47", SizeDelta: 1264128},
+		{Name: "hello", Change: ClosureAdded, NewVersions: "2.10", SizeDelta: 204800},
+		{Name: "nano", Change: ClosureRemoved, OldVersions: "5.4", SizeDelta: -2097152},
+		{Name: "firefox", Change: ClosureUpgraded, OldVersions: "90.0, 91.0", NewVersions: "92.0"},
+		{Name: "source", Change: ClosureUpgraded, NewVersions: "1.0"},
+		{Name: "nixos-system-web1", Change: ClosureResized, SizeDelta: -12595},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("got changes:\n%+v\nwant:\n%+v", changes, want)
+	}
+
+	_, err = parseClosureDiff("copying 3 paths\n")
+	if err == nil {
+		t.Fatal("expected an error for unexpected output")
+	}
+}
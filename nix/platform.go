@@ -0,0 +1,166 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Platform selects the systems builds are for.
+type Platform struct {
+	// System is the platform builds run on, such as aarch64-linux. Our own if empty.
+	System string
+	// CrossSystem is the platform cross compiled outputs run on, if set.
+	CrossSystem string
+}
+
+// HostSystem returns the platform outputs run on, or an empty string if it
+// is our own.
+func (p Platform) HostSystem() string {
+	if p.CrossSystem != "" {
+		return p.CrossSystem
+	}
+	return p.System
+}
+
+// expressionArgs returns the arguments to nix-build passing the platform to
+// an expression. They are only passed to expressions that are functions
+// accepting system and crossSystem.
+func (p Platform) expressionArgs() []string {
+	args := []string{}
+	if p.System != "" {
+		args = append(args, "--option", "system", p.System, "--argstr", "system", p.System)
+	}
+	if p.CrossSystem != "" {
+		args = append(args, "--arg", "crossSystem", fmt.Sprintf("{ system = %q; }", p.CrossSystem))
+	}
+	return args
+}
+
+// nixosConfig returns a nixos configuration importing nixosConfigPath that
+// builds for the platform, and a function removing it.
+func (p Platform) nixosConfig(nixosConfigPath string) (string, func(), error) {
+	if p.System == "" && p.CrossSystem == "" {
+		return nixosConfigPath, func() {}, nil
+	}
+
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+
+	var module strings.Builder
+	fmt.Fprintf(&module, "{ lib, ... }:\n{\n  imports = [ %q ];\n", nixosConfigPath)
+	if p.System != "" {
+		fmt.Fprintf(&module, "  nixpkgs.localSystem = lib.mkDefault { system = %q; };\n", p.System)
+	}
+	if p.CrossSystem != "" {
+		fmt.Fprintf(&module, "  nixpkgs.crossSystem = lib.mkDefault { system = %q; };\n", p.CrossSystem)
+	}
+	module.WriteString("}\n")
+
+	wrapperPath := filepath.Join(tmpDir, "configuration.nix")
+	err = ioutil.WriteFile(wrapperPath, []byte(module.String()), 0644)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return wrapperPath, cleanup, nil
+}
+
+// supports reports if a builder can build for system.
+func (b *Builder) supports(system string) bool {
+	if len(b.Systems) == 0 {
+		return true
+	}
+	for _, s := range b.Systems {
+		if s == system {
+			return true
+		}
+	}
+	return false
+}
+
+// buildOptions returns the command line options for nix commands building
+// for the platform with builders, and a function removing any files they
+// refer to. Only builders for the platform are used, without any we try to
+// build locally, which works when the nix daemon emulates the system with binfmt.
+func (p Platform) buildOptions(builders Builders) ([]string, func(), error) {
+	if p.System == "" {
+		return builders.options()
+	}
+
+	supported := Builders{}
+	for _, b := range builders {
+		if b.supports(p.System) {
+			supported = append(supported, b)
+		}
+	}
+
+	opts, cleanup, err := supported.options()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(supported) == 0 {
+		opts = append(opts, "--option", "extra-platforms", p.System)
+	}
+
+	return opts, cleanup, nil
+}
+
+// architectureSystems maps uname -m of linux hosts to nix systems.
+var architectureSystems = map[string]string{
+	"x86_64":  "x86_64-linux",
+	"i686":    "i686-linux",
+	"aarch64": "aarch64-linux",
+	"armv6l":  "armv6l-linux",
+	"armv7l":  "armv7l-linux",
+	"riscv64": "riscv64-linux",
+}
+
+// compatibleSystems lists the systems that run on a kernel of another
+// system, besides its own.
+var compatibleSystems = map[string][]string{
+	"x86_64-linux":  {"i686-linux"},
+	"aarch64-linux": {"armv7l-linux", "armv6l-linux"},
+	"armv7l-linux":  {"armv6l-linux"},
+}
+
+// CheckTargetSystem returns an error if the target cannot run outputs built for system.
+func CheckTargetSystem(target Transport, system string) error {
+	machine, err := runOn(target, "uname -m")
+	if err != nil {
+		return err
+	}
+
+	targetSystem, ok := architectureSystems[machine]
+	if !ok {
+		targetSystem = machine + "-linux"
+	}
+
+	if targetSystem == system {
+		return nil
+	}
+	for _, compatible := range compatibleSystems[targetSystem] {
+		if compatible == system {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s is %s, but the system was built for %s", target, targetSystem, system)
+}
+
+// CheckTargetRunsSystem is CheckTargetSystem for a nixos system already in
+// the target's store, using the platform it records.
+func CheckTargetRunsSystem(target Transport, systemPath string) error {
+	system, err := runOn(target, "cat "+shellQuote(systemPath+"/system"))
+	if err != nil {
+		return err
+	}
+	return CheckTargetSystem(target, system)
+}
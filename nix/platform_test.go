@@ -0,0 +1,43 @@
+package nix
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckTargetSystem(t *testing.T) {
+	tests := []struct {
+		machine string
+		system  string
+		wantErr string
+	}{
+		{"x86_64", "x86_64-linux", ""},
+		{"x86_64", "i686-linux", ""},
+		{"aarch64", "aarch64-linux", ""},
+		{"aarch64", "armv7l-linux", ""},
+		{"aarch64", "armv6l-linux", ""},
+		{"armv7l", "armv6l-linux", ""},
+		{"mips64", "mips64-linux", ""},
+		{"x86_64", "aarch64-linux", "localhost is x86_64-linux, but the system was built for aarch64-linux"},
+		{"i686", "x86_64-linux", "localhost is i686-linux, but the system was built for x86_64-linux"},
+		{"armv7l", "aarch64-linux", "localhost is armv7l-linux, but the system was built for aarch64-linux"},
+		{"aarch64", "x86_64-linux", "localhost is aarch64-linux, but the system was built for x86_64-linux"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.machine+" "+tc.system, func(t *testing.T) {
+			fakeCommand(t, "uname", "echo "+tc.machine)
+
+			err := CheckTargetSystem(&LocalTarget{}, tc.system)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
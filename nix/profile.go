@@ -0,0 +1,41 @@
+package nix
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SetProfile points a nix profile on the target at storePath, creating a new
+// generation. The closure must already be present on the target.
+func SetProfile(target *SSHTarget, profile, storePath string) error {
+	_, err := target.Run(fmt.Sprintf(`set -e
+mkdir -p "$(dirname %s)"
+nix-env -p %s --set %s
+`, shellQuote(profile), shellQuote(profile), shellQuote(storePath)))
+	return err
+}
+
+// ReadProfile returns the store path and generation a profile on the target
+// currently points to, or an empty store path if the profile does not exist.
+func ReadProfile(target *SSHTarget, profile string) (string, int, error) {
+	output, err := target.Run(fmt.Sprintf(`if test -e %s; then
+  echo "generation=$(readlink %s)"
+  echo "store_path=$(readlink -f %s)"
+fi
+`, shellQuote(profile), shellQuote(profile), shellQuote(profile)))
+	if err != nil {
+		return "", 0, err
+	}
+
+	values := parseKeyValues(output)
+	return values["store_path"], parseGeneration(values["generation"]), nil
+}
+
+// RollbackProfile switches a profile on the target to its previous generation.
+func RollbackProfile(target *SSHTarget, profile string) error {
+	_, err := target.Run(fmt.Sprintf("nix-env -p %s --rollback", shellQuote(profile)))
+	if err != nil && strings.Contains(err.Error(), "no generation older than the current") {
+		return nil
+	}
+	return err
+}
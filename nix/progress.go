@@ -0,0 +1,284 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFormatArgs make nix commands write their logs as internal-json, which
+// buildProgress parses.
+var logFormatArgs = []string{"--log-format", "internal-json"}
+
+// progressInterval is how often a summary of running nix commands is logged.
+var progressInterval = 30 * time.Second
+
+// buildLogLines is how many lines of each derivation's build log are kept.
+const buildLogLines = 50
+
+// Activity types, from nix's logging.hh.
+const (
+	actFileTransfer = 101
+	actCopyPaths    = 103
+	actBuilds       = 104
+	actBuild        = 105
+	actSubstitute   = 108
+)
+
+// Result types, from nix's logging.hh.
+const (
+	resBuildLogLine = 101
+	resSetPhase     = 104
+	resProgress     = 105
+)
+
+// nixLogEntry is one line of --log-format internal-json output, without
+// its "@nix " prefix.
+type nixLogEntry struct {
+	Action string            `json:"action"`
+	ID     uint64            `json:"id"`
+	Level  int               `json:"level"`
+	Type   int               `json:"type"`
+	Text   string            `json:"text"`
+	Msg    string            `json:"msg"`
+	Parent uint64            `json:"parent"`
+	Fields []json.RawMessage `json:"fields"`
+}
+
+func (e *nixLogEntry) stringField(i int) string {
+	var s string
+	if i < len(e.Fields) {
+		_ = json.Unmarshal(e.Fields[i], &s)
+	}
+	return s
+}
+
+func (e *nixLogEntry) intField(i int) int64 {
+	var n int64
+	if i < len(e.Fields) {
+		_ = json.Unmarshal(e.Fields[i], &n)
+	}
+	return n
+}
+
+type activity struct {
+	Type     int
+	Drv      string
+	Phase    string
+	Done     int64
+	Expected int64
+	Running  bool
+}
+
+// buildProgress follows the activities of a nix command run with
+// logFormatArgs, periodically logging a summary of them and keeping
+// the end of the build log of each derivation.
+type buildProgress struct {
+	label string
+
+	mu         sync.Mutex
+	activities map[uint64]*activity
+	buildLogs  map[string][]string
+	changed    bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBuildProgress(label string) *buildProgress {
+	return &buildProgress{
+		label:      label,
+		activities: make(map[uint64]*activity),
+		buildLogs:  make(map[string][]string),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// start logs a summary every progressInterval until finish is called.
+func (p *buildProgress) start() {
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				summary := p.summary()
+				p.changed = false
+				p.mu.Unlock()
+				if summary != "" {
+					log.Printf("[INFO] %s: %s", p.label, summary)
+				}
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *buildProgress) finish() {
+	close(p.stop)
+	<-p.done
+}
+
+// parseLine handles one line of output. It returns the line as nix would
+// have printed it without internal-json, which is empty for lines that
+// only report progress.
+func (p *buildProgress) parseLine(line string) string {
+	if !strings.HasPrefix(line, "@nix ") {
+		return line
+	}
+
+	var e nixLogEntry
+	err := json.Unmarshal([]byte(strings.TrimPrefix(line, "@nix ")), &e)
+	if err != nil {
+		return line
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch e.Action {
+	case "msg":
+		return ansiEscape.ReplaceAllString(e.Msg, "") + "\n"
+
+	case "start":
+		a := &activity{Type: e.Type, Running: true}
+		if e.Type == actBuild {
+			a.Drv = e.stringField(0)
+			if machine := e.stringField(1); machine != "" {
+				log.Printf("[INFO] %s: building %s on %s", p.label, a.Drv, machine)
+			} else {
+				log.Printf("[INFO] %s: building %s", p.label, a.Drv)
+			}
+		}
+		p.activities[e.ID] = a
+		p.changed = true
+		if e.Text != "" {
+			return e.Text + "\n"
+		}
+
+	case "stop":
+		if a, ok := p.activities[e.ID]; ok {
+			a.Running = false
+			p.changed = true
+		}
+
+	case "result":
+		a, ok := p.activities[e.ID]
+		if !ok {
+			return ""
+		}
+		switch e.Type {
+		case resBuildLogLine:
+			text := e.stringField(0)
+			if a.Drv != "" {
+				lines := append(p.buildLogs[a.Drv], text)
+				if len(lines) > buildLogLines {
+					lines = lines[len(lines)-buildLogLines:]
+				}
+				p.buildLogs[a.Drv] = lines
+			}
+			return text + "\n"
+		case resSetPhase:
+			a.Phase = e.stringField(0)
+		case resProgress:
+			a.Done = e.intField(0)
+			a.Expected = e.intField(1)
+		}
+		p.changed = true
+	}
+
+	return ""
+}
+
+// summary describes the activities, such as
+// "built 1/3, building hello-2.10: buildPhase, copied 4/10 paths".
+// It is empty when nothing is running and nothing has changed since the
+// last summary.
+func (p *buildProgress) summary() string {
+	var builds, copies, downloads [2]int64
+	running := []string{}
+	substituting := 0
+
+	for _, a := range p.activities {
+		switch a.Type {
+		case actBuilds:
+			builds[0] += a.Done
+			builds[1] += a.Expected
+		case actCopyPaths:
+			copies[0] += a.Done
+			copies[1] += a.Expected
+		case actFileTransfer:
+			downloads[0] += a.Done
+			downloads[1] += a.Expected
+		case actBuild:
+			if a.Running {
+				name := derivationName(a.Drv)
+				if a.Phase != "" {
+					name += ": " + a.Phase
+				}
+				running = append(running, name)
+			}
+		case actSubstitute:
+			if a.Running {
+				substituting++
+			}
+		}
+	}
+
+	parts := []string{}
+	if builds[1] != 0 || len(running) != 0 {
+		sort.Strings(running)
+		part := fmt.Sprintf("built %d/%d", builds[0], builds[1])
+		if len(running) != 0 {
+			part += fmt.Sprintf(", building %s", strings.Join(running, ", "))
+		}
+		parts = append(parts, part)
+	}
+	if copies[1] != 0 {
+		parts = append(parts, fmt.Sprintf("copied %d/%d paths", copies[0], copies[1]))
+	}
+	if substituting != 0 {
+		parts = append(parts, fmt.Sprintf("substituting %d paths", substituting))
+	}
+	if downloads[1] != 0 {
+		parts = append(parts, fmt.Sprintf("downloaded %.1f/%.1f MiB", float64(downloads[0])/(1<<20), float64(downloads[1])/(1<<20)))
+	}
+
+	if !p.changed && len(running) == 0 && substituting == 0 {
+		return ""
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// logs returns the kept end of the build log of each derivation.
+func (p *buildProgress) logs() map[string][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	logs := make(map[string][]string, len(p.buildLogs))
+	for drv, lines := range p.buildLogs {
+		logs[drv] = append([]string(nil), lines...)
+	}
+	return logs
+}
+
+// derivationName is the name of a derivation without its store hash, such as hello-2.10.
+func derivationName(drvPath string) string {
+	name := strings.TrimSuffix(path.Base(drvPath), ".drv")
+	if i := strings.IndexByte(name, '-'); i != -1 {
+		name = name[i+1:]
+	}
+	return name
+}
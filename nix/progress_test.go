@@ -0,0 +1,116 @@
+package nix
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Lines recorded from nix-build --log-format internal-json.
+const (
+	nixStartBuilds   = `@nix {"action":"start","fields":[],"id":1,"level":0,"parent":0,"text":"","type":104}`
+	nixStartCopies   = `@nix {"action":"start","fields":[],"id":2,"level":0,"parent":0,"text":"","type":103}`
+	nixStartBuild    = `@nix {"action":"start","fields":["/nix/store/0wzx0wq5jw8lf5gqahhy0hbkh3hvjfhz-hello-2.12.1.drv","",1,1],"id":3,"level":3,"parent":0,"text":"building '/nix/store/0wzx0wq5jw8lf5gqahhy0hbkh3hvjfhz-hello-2.12.1.drv'","type":105}`
+	nixSetPhase      = `@nix {"action":"result","fields":["buildPhase"],"id":3,"type":104}`
+	nixLogLine1      = `@nix {"action":"result","fields":["make: Entering directory '/build/hello-2.12.1'"],"id":3,"type":101}`
+	nixLogLine2      = `@nix {"action":"result","fields":["make: *** No rule to make target 'install'."],"id":3,"type":101}`
+	nixBuildsRunning = `@nix {"action":"result","fields":[0,1,1,0],"id":1,"type":105}`
+	nixBuildsDone    = `@nix {"action":"result","fields":[1,1,0,0],"id":1,"type":105}`
+	nixCopiesDone    = `@nix {"action":"result","fields":[4,10,0,0],"id":2,"type":105}`
+	nixStopBuild     = `@nix {"action":"stop","id":3}`
+	nixBuildFailed   = `@nix {"action":"msg","level":0,"msg":"\u001b[31;1merror:\u001b[0m builder for '\u001b[35;1m/nix/store/0wzx0wq5jw8lf5gqahhy0hbkh3hvjfhz-hello-2.12.1.drv\u001b[0m' failed with exit code 2"}`
+	nixUnknownResult = `@nix {"action":"result","fields":["orphan"],"id":99,"type":101}`
+)
+
+const helloDrv = "/nix/store/0wzx0wq5jw8lf5gqahhy0hbkh3hvjfhz-hello-2.12.1.drv"
+
+func TestBuildProgressParseLine(t *testing.T) {
+	tests := []struct {
+		name        string
+		lines       []string
+		wantText    string
+		wantSummary string
+		wantLogs    map[string][]string
+	}{
+		{
+			name:     "plain output",
+			lines:    []string{"/nix/store/aaaa-hello-2.12.1", "@nix not json"},
+			wantText: "/nix/store/aaaa-hello-2.12.1\n@nix not json\n",
+			wantLogs: map[string][]string{},
+		},
+		{
+			name:        "running build",
+			lines:       []string{nixStartBuilds, nixStartCopies, nixStartBuild, nixBuildsRunning, nixSetPhase, nixLogLine1, nixCopiesDone},
+			wantText:    "building '" + helloDrv + "'\nmake: Entering directory '/build/hello-2.12.1'\n",
+			wantSummary: "built 0/1, building hello-2.12.1: buildPhase, copied 4/10 paths",
+			wantLogs:    map[string][]string{helloDrv: {"make: Entering directory '/build/hello-2.12.1'"}},
+		},
+		{
+			name:        "finished build",
+			lines:       []string{nixStartBuilds, nixStartBuild, nixLogLine1, nixBuildsDone, nixStopBuild},
+			wantText:    "building '" + helloDrv + "'\nmake: Entering directory '/build/hello-2.12.1'\n",
+			wantSummary: "built 1/1",
+			wantLogs:    map[string][]string{helloDrv: {"make: Entering directory '/build/hello-2.12.1'"}},
+		},
+		{
+			name:     "result of an unknown activity",
+			lines:    []string{nixUnknownResult},
+			wantLogs: map[string][]string{},
+		},
+		{
+			name:        "failed build",
+			lines:       []string{nixStartBuilds, nixStartBuild, nixBuildsRunning, nixLogLine1, nixLogLine2, nixStopBuild, nixBuildFailed},
+			wantText:    "building '" + helloDrv + "'\nmake: Entering directory '/build/hello-2.12.1'\nmake: *** No rule to make target 'install'.\nerror: builder for '" + helloDrv + "' failed with exit code 2\n",
+			wantSummary: "built 0/1",
+			wantLogs:    map[string][]string{helloDrv: {"make: Entering directory '/build/hello-2.12.1'", "make: *** No rule to make target 'install'."}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newBuildProgress("nix-build")
+
+			var text strings.Builder
+			for _, line := range tc.lines {
+				text.WriteString(p.parseLine(line + "\n"))
+			}
+
+			if text.String() != tc.wantText {
+				t.Fatalf("got text:\n%q\nwant:\n%q", text.String(), tc.wantText)
+			}
+			if summary := p.summary(); summary != tc.wantSummary {
+				t.Fatalf("got summary %q, want %q", summary, tc.wantSummary)
+			}
+			if logs := p.logs(); !reflect.DeepEqual(logs, tc.wantLogs) {
+				t.Fatalf("got logs %q, want %q", logs, tc.wantLogs)
+			}
+		})
+	}
+}
+
+// TestBuildProgressBuildError checks a failed build's log is taken from
+// internal-json, as nix doesn't repeat it in the error.
+func TestBuildProgressBuildError(t *testing.T) {
+	p := newBuildProgress("nix-build")
+
+	var stderr strings.Builder
+	for _, line := range []string{nixStartBuilds, nixStartBuild, nixLogLine1, nixLogLine2, nixStopBuild, nixBuildFailed} {
+		stderr.WriteString(p.parseLine(line + "\n"))
+	}
+
+	err := classifyCommandErr(&commandError{
+		Args:      []string{"nix-build"},
+		ExitCode:  1,
+		Stderr:    stderr.String(),
+		BuildLogs: p.logs(),
+	})
+
+	want := &BuildError{
+		Derivation: helloDrv,
+		Message:    "exit code 2",
+		LogTail:    "make: Entering directory '/build/hello-2.12.1'\nmake: *** No rule to make target 'install'.",
+	}
+	if !reflect.DeepEqual(err, want) {
+		t.Fatalf("got %T %#v\nwant %#v", err, err, want)
+	}
+}
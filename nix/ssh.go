@@ -0,0 +1,74 @@
+package nix
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// SSHTarget is a host we run commands on over ssh.
+type SSHTarget struct {
+	User    string
+	Host    string
+	SSHOpts string
+	// ConnectTimeout bounds connecting to the host, if set.
+	ConnectTimeout time.Duration
+}
+
+// Address returns user@host.
+func (t *SSHTarget) Address() string {
+	return fmt.Sprintf("%s@%s", t.User, t.Host)
+}
+
+// Command returns a command running script on the target.
+func (t *SSHTarget) Command(script string) *exec.Cmd {
+	return sshCommand(t.User, t.Host, t.opts(), script)
+}
+
+// opts returns SSHOpts with the ConnectTimeout.
+func (t *SSHTarget) opts() string {
+	return withConnectTimeout(t.SSHOpts, t.ConnectTimeout)
+}
+
+func (t *SSHTarget) String() string {
+	return t.Host
+}
+
+// Run runs script on the target, returning its trimmed stdout.
+func (t *SSHTarget) Run(script string) (string, error) {
+	return runOn(t, script)
+}
+
+// sshCommand returns a command that runs script on host as user.
+// The script is passed to the remote shell verbatim.
+func sshCommand(user, host, sshOpts, script string) *exec.Cmd {
+	return exec.Command("sh", "-c", fmt.Sprintf("exec ssh %s \"$@\"", sshOpts), "ssh", fmt.Sprintf("%s@%s", user, host), "--", script)
+}
+
+// withConnectTimeout adds a ConnectTimeout to ssh options, so an unreachable
+// host fails instead of hanging. A ConnectTimeout in sshOpts takes precedence.
+func withConnectTimeout(sshOpts string, timeout time.Duration) string {
+	if timeout <= 0 {
+		return sshOpts
+	}
+	return fmt.Sprintf("%s -o ConnectTimeout=%d", sshOpts, int(timeout.Seconds()+0.5))
+}
+
+// shellQuote quotes s for use as a single word in a posix shell script.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// parseKeyValues parses lines of key=value output from remote scripts.
+func parseKeyValues(output string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			continue
+		}
+		values[strings.TrimSpace(line[:idx])] = strings.TrimSpace(line[idx+1:])
+	}
+	return values
+}
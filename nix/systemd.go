@@ -0,0 +1,163 @@
+package nix
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnitChanges records what DeployUnits did to each unit.
+type UnitChanges struct {
+	Units     []string
+	Started   []string
+	Restarted []string
+	Stopped   []string
+}
+
+// The unit directory on generic linux hosts. Units are linked through the
+// profile so their store paths are protected from garbage collection. Unit
+// files there that are not our links belong to someone else, so the deploy
+// refuses to replace them.
+const deployUnitsScript = `set -e
+profile=%s
+new=%s
+unitdir=/etc/systemd/system
+
+conflicts=""
+for f in "$new"/*; do
+  test -e "$f" || continue
+  u="$(basename "$f")"
+  if test -e "$unitdir/$u" || test -L "$unitdir/$u"; then
+    test "$(readlink "$unitdir/$u")" = "$profile/$u" || conflicts="$conflicts $unitdir/$u"
+  fi
+done
+if test -n "$conflicts"; then
+  echo "refusing to replace unit files not deployed to $profile:$conflicts" >&2
+  exit 1
+fi
+
+old=""
+if test -e "$profile"; then
+  old="$(readlink -f "$profile")"
+fi
+
+removed=""
+unlinked=""
+if test -n "$old"; then
+  for f in "$old"/*; do
+    test -e "$f" || continue
+    u="$(basename "$f")"
+    if ! test -e "$new/$u"; then
+      case "$u" in *@.*) ;; *) test -d "$f" || removed="$removed $u" ;; esac
+      unlinked="$unlinked $u"
+    fi
+  done
+fi
+
+# Removed units are stopped and disabled before the profile is switched,
+# while their links still lead to the old generation, as disable reads
+# their [Install] section.
+for u in $removed; do
+  systemctl stop "$u" || true
+  systemctl disable "$u" || true
+done
+
+mkdir -p "$(dirname "$profile")"
+nix-env -p "$profile" --set "$new"
+
+for u in $unlinked; do
+  rm -f "$unitdir/$u"
+done
+
+units=""
+added=""
+changed=""
+
+for f in "$new"/*; do
+  test -e "$f" || continue
+  u="$(basename "$f")"
+  units="$units $u"
+  ln -sfn "$profile/$u" "$unitdir/$u"
+  # Drop-in directories and templates are picked up by daemon-reload alone.
+  if test -d "$f"; then continue; fi
+  case "$u" in *@.*) continue ;; esac
+  if test -n "$old" && test -e "$old/$u"; then
+    cmp -s "$old/$u" "$f" || changed="$changed $u"
+  else
+    added="$added $u"
+  fi
+done
+
+systemctl daemon-reload
+
+for u in $added; do
+  systemctl enable "$u"
+  systemctl start "$u"
+done
+
+# Disabling also removes the link to the unit, so it is made again.
+for u in $changed; do
+  systemctl disable "$u"
+  ln -sfn "$profile/$u" "$unitdir/$u"
+  systemctl enable "$u"
+  systemctl restart "$u"
+done
+
+echo "units=$units"
+echo "started=$added"
+echo "restarted=$changed"
+echo "stopped=$removed"
+`
+
+// DeployUnits links the systemd units in unitsPath into /etc/systemd/system
+// on the target, via a nix profile. Units new since the last deploy are enabled
+// and started, changed units reenabled and restarted, and removed units stopped
+// and disabled. It fails without changing anything if a unit file it would
+// replace was not deployed to profile. The closure must already be present
+// on the target.
+func DeployUnits(target *SSHTarget, profile, unitsPath string) (UnitChanges, error) {
+	output, err := target.Run(fmt.Sprintf(deployUnitsScript, shellQuote(profile), shellQuote(unitsPath)))
+	if err != nil {
+		return UnitChanges{}, err
+	}
+
+	values := parseKeyValues(output)
+
+	return UnitChanges{
+		Units:     strings.Fields(values["units"]),
+		Started:   strings.Fields(values["started"]),
+		Restarted: strings.Fields(values["restarted"]),
+		Stopped:   strings.Fields(values["stopped"]),
+	}, nil
+}
+
+const removeUnitsScript = `set -e
+profile=%s
+unitdir=/etc/systemd/system
+
+if test -e "$profile"; then
+  current="$(readlink -f "$profile")"
+  for f in "$current"/*; do
+    test -e "$f" || continue
+    u="$(basename "$f")"
+    if ! test -d "$f"; then
+      case "$u" in *@.*) ;; *) systemctl stop "$u" || true; systemctl disable "$u" || true ;; esac
+    fi
+  done
+  for f in "$current"/*; do
+    u="$(basename "$f")"
+    if test "$(readlink "$unitdir/$u")" = "$profile/$u"; then
+      rm -f "$unitdir/$u"
+    fi
+  done
+  systemctl daemon-reload
+fi
+
+rm -f "$profile" "$profile"-*-link
+`
+
+// RemoveUnits stops, disables and unlinks all units deployed by DeployUnits,
+// then removes the profile.
+func RemoveUnits(target *SSHTarget, profile string) error {
+	_, err := target.Run(fmt.Sprintf(removeUnitsScript, shellQuote(profile)))
+	return err
+}
@@ -0,0 +1,126 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runUnitsScript runs a units script locally against a temporary unit
+// directory, with systemctl and nix-env faked. It returns the script's
+// output and the systemctl calls it made. Like systemctl, the fake fails
+// a call for a unit whose file does not resolve, recording it as unresolved.
+func runUnitsScript(t *testing.T, dir, script string) (string, []string, error) {
+	calls := filepath.Join(dir, "systemctl-calls")
+	unitdir := filepath.Join(dir, "etc")
+	_ = os.Remove(calls)
+	fakeCommand(t, "systemctl", `if test -n "$2" && ! test -f '`+unitdir+`'/"$2"; then
+  echo unresolved "$@" >> '`+calls+`'
+  exit 1
+fi
+echo "$@" >> '`+calls+`'`)
+	fakeCommand(t, "nix-env", `ln -sfn "$4" "$2"`)
+
+	script = strings.Replace(script, "unitdir=/etc/systemd/system", "unitdir="+shellQuote(unitdir), 1)
+	out, err := exec.Command("sh", "-c", script).CombinedOutput()
+
+	b, _ := ioutil.ReadFile(calls)
+	return string(out), strings.Fields(strings.Replace(string(b), " ", "_", -1)), err
+}
+
+func writeUnits(t *testing.T, dir string, units map[string]string) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range units {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeployUnitsScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "units")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	profile := filepath.Join(dir, "profiles", "units")
+	unitdir := filepath.Join(dir, "etc")
+	writeUnits(t, unitdir, map[string]string{"sshd.service": "[Service]\n"})
+
+	gen1 := filepath.Join(dir, "gen1")
+	writeUnits(t, gen1, map[string]string{"app.service": "v1", "worker.service": "v1", "old.service": "v1"})
+	gen2 := filepath.Join(dir, "gen2")
+	writeUnits(t, gen2, map[string]string{"app.service": "v2", "worker.service": "v1", "new.service": "v1"})
+	gen3 := filepath.Join(dir, "gen3")
+	writeUnits(t, gen3, map[string]string{"app.service": "v2", "sshd.service": "[Service]\nExecStart=/bin/false\n"})
+
+	deploy := func(gen string) (string, []string, error) {
+		return runUnitsScript(t, dir, fmt.Sprintf(deployUnitsScript, shellQuote(profile), shellQuote(gen)))
+	}
+
+	out, calls, err := deploy(gen1)
+	if err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	want := "daemon-reload enable_app.service start_app.service enable_old.service start_old.service enable_worker.service start_worker.service"
+	if strings.Join(calls, " ") != want {
+		t.Fatalf("got systemctl calls:\n%s\nwant:\n%s", strings.Join(calls, " "), want)
+	}
+	link, err := os.Readlink(filepath.Join(unitdir, "app.service"))
+	if err != nil || link != profile+"/app.service" {
+		t.Fatalf("app.service links to %q, %v", link, err)
+	}
+
+	out, calls, err = deploy(gen2)
+	if err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	want = "stop_old.service disable_old.service daemon-reload enable_new.service start_new.service disable_app.service enable_app.service restart_app.service"
+	if strings.Join(calls, " ") != want {
+		t.Fatalf("got systemctl calls:\n%s\nwant:\n%s", strings.Join(calls, " "), want)
+	}
+	if _, err := os.Lstat(filepath.Join(unitdir, "old.service")); !os.IsNotExist(err) {
+		t.Fatalf("old.service is still linked: %v", err)
+	}
+	if !strings.Contains(out, "started= new.service\nrestarted= app.service\nstopped= old.service\n") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	// sshd.service is the host's own, it is left alone along with the deployed units.
+	out, calls, err = deploy(gen3)
+	if err == nil || !strings.Contains(out, "refusing to replace unit files not deployed to "+profile+": "+unitdir+"/sshd.service") {
+		t.Fatalf("got %v: %s, want a refusal to replace sshd.service", err, out)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("systemctl was called: %v", calls)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(unitdir, "sshd.service")); err != nil || string(b) != "[Service]\n" {
+		t.Fatalf("sshd.service was changed: %q %v", b, err)
+	}
+	current, err := filepath.EvalSymlinks(profile)
+	if err != nil || current != gen2 {
+		t.Fatalf("profile is %s, want it left at %s: %v", current, gen2, err)
+	}
+
+	out, calls, err = runUnitsScript(t, dir, fmt.Sprintf(removeUnitsScript, shellQuote(profile)))
+	if err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	want = "stop_app.service disable_app.service stop_new.service disable_new.service stop_worker.service disable_worker.service daemon-reload"
+	if strings.Join(calls, " ") != want {
+		t.Fatalf("got systemctl calls:\n%s\nwant:\n%s", strings.Join(calls, " "), want)
+	}
+	entries, err := ioutil.ReadDir(unitdir)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "sshd.service" {
+		t.Fatalf("unit directory was not cleaned up: %v %v", entries, err)
+	}
+}
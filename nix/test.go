@@ -0,0 +1,88 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// InstantiateExpression evaluates a nix expression to its derivation without building it.
+func InstantiateExpression(nixPath, expressionPath string) (string, error) {
+	cmd := exec.Command("nix-instantiate", expressionPath)
+	cmd.Env = []string{fmt.Sprintf("NIX_PATH=%s", nixPath)}
+
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(cmd, output)
+	if err != nil {
+		return "", fmt.Errorf("evaluating expression failed: %w", formatChildErr(err))
+	}
+
+	return strings.TrimSpace(output.String()), nil
+}
+
+// TestFailure is returned when a nixos test ran and did not pass.
+type TestFailure struct {
+	DrvPath string
+	LogPath string
+	LogTail string
+}
+
+func (e *TestFailure) Error() string {
+	return fmt.Sprintf("nixos test %s failed, the full log is in %s:\n%s", e.DrvPath, e.LogPath, e.LogTail)
+}
+
+// RunTest builds the derivation of a nixosTest, which runs the test, writing
+// the complete output to logPath. It returns the test output path if the test passed.
+func RunTest(drvPath, logPath string, builders Builders) (string, error) {
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return "", err
+	}
+	defer logFile.Close()
+
+	opts, cleanup, err := builders.options()
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	cmd := exec.Command("nix-build", append([]string{"--no-link", drvPath}, append(opts, logFormatArgs...)...)...)
+	cmd.Env = os.Environ()
+
+	output := bytes.NewBuffer(nil)
+	err = runNixCommandWithTranscript(cmd, output, logFile)
+	if err != nil {
+		err = formatChildErr(err)
+
+		// Only the test derivation failing to build is the test failing,
+		// anything else is a failure to evaluate or build what it needs.
+		var buildErr *BuildError
+		if errors.As(err, &buildErr) && buildErr.Derivation == drvPath {
+			logTail, tailErr := tailFile(logPath, 30)
+			if tailErr != nil {
+				logTail = buildErr.LogTail
+			}
+			return "", &TestFailure{DrvPath: drvPath, LogPath: logPath, LogTail: logTail}
+		}
+		return "", fmt.Errorf("running nixos test %s failed: %w", drvPath, err)
+	}
+
+	return strings.TrimSpace(output.String()), nil
+}
+
+// tailFile returns the last n lines of a file.
+func tailFile(path string, n int) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,79 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeCommand puts an executable script called name first on the PATH.
+func fakeCommand(t *testing.T, name, script string) {
+	dir, err := ioutil.TempDir("", "fake-"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	err = ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+}
+
+func TestRunTestFailures(t *testing.T) {
+	const testDrv = "/nix/store/aaaa-vm-test-run-login.drv"
+	const depDrv = "/nix/store/bbbb-hello-2.10.drv"
+
+	failure := func(drv string) string {
+		return fmt.Sprintf(`echo "machine: waiting for unit login.target" >&2
+echo "error: builder for '%s' failed with exit code 1" >&2
+exit 1
+`, drv)
+	}
+
+	tests := []struct {
+		name        string
+		script      string
+		testFailure bool
+		buildErrDrv string
+	}{
+		{name: "test failed", script: failure(testDrv), testFailure: true},
+		{name: "dependency failed", script: failure(depDrv), buildErrDrv: depDrv},
+		{name: "evaluation failed", script: "echo \"error: attribute 'nodes' missing, at /tmp/test.nix:3:5\" >&2\nexit 1\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeCommand(t, "nix-build", tc.script)
+
+			logDir, err := ioutil.TempDir("", "nixos-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(logDir)
+
+			logPath := filepath.Join(logDir, "test.log")
+			_, err = RunTest(testDrv, logPath, nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			var testFailure *TestFailure
+			if errors.As(err, &testFailure) != tc.testFailure {
+				t.Fatalf("got %T %q, test failure is %v", err, err, tc.testFailure)
+			}
+
+			var buildErr *BuildError
+			if tc.buildErrDrv != "" && (!errors.As(err, &buildErr) || buildErr.Derivation != tc.buildErrDrv) {
+				t.Fatalf("got %q, want a build error for %s", err, tc.buildErrDrv)
+			}
+		})
+	}
+}
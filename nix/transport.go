@@ -0,0 +1,212 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// Transports for reaching a target host.
+const (
+	TransportSSH        = "ssh"
+	TransportLocal      = "local"
+	TransportDocker     = "docker"
+	TransportMachinectl = "machinectl"
+)
+
+// Transports lists the supported transports.
+var Transports = []string{TransportSSH, TransportLocal, TransportDocker, TransportMachinectl}
+
+// Transport runs scripts on a target host.
+type Transport interface {
+	// Command returns a command running script on the target.
+	Command(script string) *exec.Cmd
+	// String describes the target for messages.
+	String() string
+}
+
+// NewTransport returns the transport of the given kind. The meaning of host
+// depends on the transport, it is a container for docker, a machine for
+// machinectl and ignored by local.
+func NewTransport(kind, user, host, sshOpts string) (Transport, error) {
+	switch kind {
+	case TransportSSH:
+		return &SSHTarget{User: user, Host: host, SSHOpts: sshOpts}, nil
+	case TransportLocal:
+		return &LocalTarget{User: user}, nil
+	case TransportDocker:
+		return &DockerTarget{Container: host, User: user}, nil
+	case TransportMachinectl:
+		return &MachinectlTarget{Machine: host, User: user}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", kind)
+	}
+}
+
+// runOn runs script with a transport, returning its trimmed stdout.
+func runOn(t Transport, script string) (string, error) {
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(t.Command(script), output)
+	if err != nil {
+		return "", fmt.Errorf("running command on %s failed: %w", t, formatChildErr(err))
+	}
+	return strings.TrimSpace(output.String()), nil
+}
+
+// shellJoin quotes args into a posix shell command line.
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// LocalTarget is the machine terraform runs on. Scripts are run with sudo
+// when User is not the user running terraform.
+type LocalTarget struct {
+	User string
+}
+
+// Command returns a command running script locally.
+func (t *LocalTarget) Command(script string) *exec.Cmd {
+	if t.User != "" {
+		current, err := user.Current()
+		if err != nil || current.Username != t.User {
+			return exec.Command("sudo", "-n", "-u", t.User, "--", "sh", "-c", script)
+		}
+	}
+	return exec.Command("sh", "-c", script)
+}
+
+func (t *LocalTarget) String() string {
+	return "localhost"
+}
+
+// DockerTarget is a running docker container with nix installed.
+type DockerTarget struct {
+	Container string
+	User      string
+}
+
+// Command returns a command running script in the container.
+func (t *DockerTarget) Command(script string) *exec.Cmd {
+	args := []string{"exec", "-i"}
+	if t.User != "" {
+		args = append(args, "-u", t.User)
+	}
+	args = append(args, t.Container, "sh", "-c", script)
+	return exec.Command("docker", args...)
+}
+
+func (t *DockerTarget) String() string {
+	return "container " + t.Container
+}
+
+// MachinectlTarget is a machine registered with systemd-machined, such as a nixos container.
+type MachinectlTarget struct {
+	Machine string
+	User    string
+}
+
+// Command returns a command running script in the machine. This uses
+// systemd-run rather than machinectl shell, which does not report the exit
+// status of what it ran.
+func (t *MachinectlTarget) Command(script string) *exec.Cmd {
+	args := []string{"--machine", t.Machine, "--quiet", "--wait", "--pipe", "--collect"}
+	if t.User != "" {
+		args = append(args, "--uid", t.User)
+	}
+	args = append(args, "/bin/sh", "-c", script)
+	return exec.Command("systemd-run", args...)
+}
+
+func (t *MachinectlTarget) String() string {
+	return "machine " + t.Machine
+}
+
+// SudoTarget runs scripts as root on another transport with sudo. Without a
+// password, sudo must not require one.
+type SudoTarget struct {
+	Transport
+	Password string
+}
+
+// Command returns a command running script as root on the target. The
+// password is passed on stdin, so it appears in neither arguments nor logs.
+func (t *SudoTarget) Command(script string) *exec.Cmd {
+	if t.Password == "" {
+		return t.Transport.Command("sudo -n sh -c " + shellQuote(script))
+	}
+
+	cmd := t.Transport.Command("sudo -S -p '' sh -c " + shellQuote(script))
+	cmd.Stdin = strings.NewReader(t.Password + "\n")
+	return cmd
+}
+
+// WaitForTarget waits until the target is ready for commands.
+func WaitForTarget(t Transport, timeout time.Duration) error {
+	if ssh, ok := t.(*SSHTarget); ok {
+		return WaitForSSH(ssh.User, ssh.Host, ssh.SSHOpts, timeout)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := runCommandWithLogging(t.Command("true"), ioutil.Discard)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New(t.String() + " down or not responsive")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// CopyToTarget copies the closure of storePath into the target's store. A
+// local target shares our store, so there is nothing to copy. A SudoTarget
+// with a password is rejected.
+func CopyToTarget(t Transport, storePath string) error {
+	switch t := t.(type) {
+	case *LocalTarget:
+		return nil
+	case *SSHTarget:
+		return CopyClosure(&CopyClosureConfig{Target: *t}, storePath)
+	}
+
+	// The closure is streamed to the import on stdin, which is where a
+	// sudo password would have to go.
+	importCmd := t.Command("nix-store --import")
+	if importCmd.Stdin != nil {
+		return fmt.Errorf("copying a closure to %s is not supported with a sudo password, copy as a user the nix daemon trusts instead", t)
+	}
+
+	closure, err := Closure(storePath)
+	if err != nil {
+		return err
+	}
+
+	output, err := runOn(t, "nix-store --check-validity --print-invalid "+shellJoin(closure))
+	if err != nil {
+		return err
+	}
+	missing := strings.Fields(output)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// The closure is in dependency order, as nix-store --import requires.
+	script := "nix-store --export \"$@\" | " + shellJoin(importCmd.Args)
+	cmd := exec.Command("sh", append([]string{"-c", script, "sh"}, missing...)...)
+	err = runCommandWithLogging(cmd, ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("copying closure to %s failed: %w", t, formatChildErr(err))
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package nix
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		kind string
+		args string
+		want string
+	}{
+		{TransportLocal, "sh -c true", "localhost"},
+		{TransportDocker, "docker exec -i -u app web sh -c true", "container web"},
+		{TransportMachinectl, "systemd-run --machine web --quiet --wait --pipe --collect --uid app /bin/sh -c true", "machine web"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.kind, func(t *testing.T) {
+			user := "app"
+			if tc.kind == TransportLocal {
+				user = ""
+			}
+			target, err := NewTransport(tc.kind, user, "web", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target.String() != tc.want {
+				t.Fatalf("got %s, want %s", target, tc.want)
+			}
+			args := strings.Join(target.Command("true").Args, " ")
+			if args != tc.args {
+				t.Fatalf("got command %s, want %s", args, tc.args)
+			}
+		})
+	}
+
+	_, err := NewTransport("telnet", "root", "web", "")
+	if err == nil || !strings.Contains(err.Error(), `unknown transport "telnet"`) {
+		t.Fatalf("got error %v, want an unknown transport", err)
+	}
+}
+
+func TestLocalTarget(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Running as ourselves doesn't need sudo.
+	target := &LocalTarget{User: current.Username}
+	output, err := runOn(target, "echo $((1 + 1))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "2" {
+		t.Fatalf("got output %q", output)
+	}
+
+	args := strings.Join((&LocalTarget{User: current.Username + "-other"}).Command("true").Args, " ")
+	if args != "sudo -n -u "+current.Username+"-other -- sh -c true" {
+		t.Fatalf("got command %s", args)
+	}
+
+	// The local store is the target's store.
+	fakeCommand(t, "nix-store", "exit 1")
+	err = CopyToTarget(target, "/nix/store/aaaa-hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSudoTarget(t *testing.T) {
+	target := &SudoTarget{Transport: &DockerTarget{Container: "web", User: "app"}, Password: "it's secret"}
+
+	cmd := target.Command("whoami")
+	args := strings.Join(cmd.Args, " ")
+	if args != `docker exec -i -u app web sh -c sudo -S -p '' sh -c 'whoami'` {
+		t.Fatalf("got command %s", args)
+	}
+	stdin, err := ioutil.ReadAll(cmd.Stdin)
+	if err != nil || string(stdin) != "it's secret\n" {
+		t.Fatalf("got stdin %q, %v", stdin, err)
+	}
+
+	target.Password = ""
+	args = strings.Join(target.Command("whoami").Args, " ")
+	if args != `docker exec -i -u app web sh -c sudo -n sh -c 'whoami'` {
+		t.Fatalf("got command %s", args)
+	}
+}
+
+// TestCopyToContainer copies a closure into a container with a faked docker,
+// which runs the command it is given locally, and a faked nix-store on each
+// side.
+func TestCopyToContainer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imported := filepath.Join(dir, "imported")
+	fakeCommand(t, "docker", `[ "$1 $2 $3" = "exec -i web" ] || exit 1
+shift 3
+exec "$@"
+`)
+	fakeCommand(t, "nix-store", `case "$1" in
+--query) echo /nix/store/aaaa-glibc; echo /nix/store/bbbb-hello ;;
+--check-validity) echo /nix/store/bbbb-hello ;;
+--export) shift; echo "nar $*" ;;
+--import) cat > '`+imported+`' ;;
+*) exit 1 ;;
+esac
+`)
+
+	err = CopyToTarget(&DockerTarget{Container: "web"}, "/nix/store/bbbb-hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "nar /nix/store/bbbb-hello\n" {
+		t.Fatalf("imported %q, want only the missing path", b)
+	}
+
+	// The password would be sent ahead of the closure, or not at all.
+	err = CopyToTarget(&SudoTarget{Transport: &DockerTarget{Container: "web"}, Password: "secret"}, "/nix/store/bbbb-hello")
+	if err == nil || !strings.Contains(err.Error(), "not supported with a sudo password") {
+		t.Fatalf("got error %v, want the sudo password rejected", err)
+	}
+}
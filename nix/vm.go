@@ -0,0 +1,227 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// VMConfig represents a configuration for running a nixos vm under qemu.
+type VMConfig struct {
+	NixPath         string
+	NixosConfigPath string
+	// StateDir holds the vm disk image, pid file and console log.
+	StateDir string
+	SSHPort  int
+	KVM      bool
+	MemoryMB int
+	Builders Builders
+	// Log keeps the output of builds, if set.
+	Log *CommandLog
+}
+
+// BuildVM builds config.system.build.vm for the configuration, returning the store path.
+func BuildVM(cfg *VMConfig) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	expression := fmt.Sprintf(`let
+  nixos = import <nixpkgs/nixos> {
+    configuration = {
+      imports = [
+        %q
+        ({ ... }: {
+          services.openssh.enable = true;
+          virtualisation.graphics = false;
+          virtualisation.memorySize = %d;
+        })
+      ];
+    };
+  };
+in
+  nixos.config.system.build.vm
+`, cfg.NixosConfigPath, cfg.MemoryMB)
+
+	expressionPath := filepath.Join(tmpDir, "vm.nix")
+	err = ioutil.WriteFile(expressionPath, []byte(expression), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return BuildExpression(cfg.NixPath, expressionPath, nil, cfg.Builders, Platform{}, cfg.Log)
+}
+
+// FreePort returns a currently unused local tcp port.
+func FreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (cfg *VMConfig) pidFile() string {
+	return filepath.Join(cfg.StateDir, "vm.pid")
+}
+
+func (cfg *VMConfig) logFile() string {
+	return filepath.Join(cfg.StateDir, "vm.log")
+}
+
+func (cfg *VMConfig) diskImage() string {
+	return filepath.Join(cfg.StateDir, "nixos.qcow2")
+}
+
+// RemoveVMState removes the files of a stopped vm from StateDir, then
+// StateDir itself. StateDir is left in place if anything else is in it,
+// it may be shared with files the vm didn't create.
+func RemoveVMState(cfg *VMConfig) error {
+	// The run script keeps its sockets and shared directories in a
+	// nix-vm.* directory under TMPDIR, which is left behind if it is killed.
+	tmpDirs, err := filepath.Glob(filepath.Join(cfg.StateDir, "nix-vm.*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range tmpDirs {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, path := range []string{cfg.pidFile(), cfg.logFile(), cfg.diskImage()} {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(cfg.StateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(entries) != 0 {
+		return nil
+	}
+
+	err = os.Remove(cfg.StateDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// StartVM boots a vm built by BuildVM in the background, forwarding SSHPort
+// on localhost to port 22 of the vm. It returns the pid of the vm.
+func StartVM(cfg *VMConfig, vmPath string) (int, error) {
+	runScripts, err := filepath.Glob(filepath.Join(vmPath, "bin", "run-*-vm"))
+	if err != nil {
+		return 0, err
+	}
+	if len(runScripts) != 1 {
+		return 0, fmt.Errorf("unable to find the vm run script in %s", vmPath)
+	}
+
+	err = os.MkdirAll(cfg.StateDir, 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	logFile, err := os.OpenFile(cfg.logFile(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer logFile.Close()
+
+	qemuOpts := ""
+	if !cfg.KVM {
+		qemuOpts = "-machine accel=tcg"
+	}
+
+	cmd := exec.Command(runScripts[0])
+	cmd.Dir = cfg.StateDir
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("NIX_DISK_IMAGE=%s", cfg.diskImage()),
+		fmt.Sprintf("QEMU_NET_OPTS=hostfwd=tcp:127.0.0.1:%d-:22", cfg.SSHPort),
+		fmt.Sprintf("QEMU_OPTS=%s", qemuOpts),
+		fmt.Sprintf("TMPDIR=%s", cfg.StateDir),
+	)
+	cmd.Stdin = nil
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// Run in its own session so the vm outlives terraform.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		return 0, fmt.Errorf("starting vm failed: %s", err)
+	}
+
+	pid := cmd.Process.Pid
+	// Reap the vm if it exits while we are still running.
+	go cmd.Wait()
+
+	err = ioutil.WriteFile(cfg.pidFile(), []byte(strconv.Itoa(pid)), 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	return pid, nil
+}
+
+// VMRunning reports if the vm with the given pid is still running.
+func VMRunning(cfg *VMConfig, pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	// The pid file guards against the pid being reused by something else.
+	b, err := ioutil.ReadFile(cfg.pidFile())
+	if err != nil || strings.TrimSpace(string(b)) != strconv.Itoa(pid) {
+		return false
+	}
+
+	return syscall.Kill(pid, 0) == nil
+}
+
+// StopVM stops a running vm, killing it if it does not exit promptly.
+func StopVM(cfg *VMConfig, pid int) error {
+	if !VMRunning(cfg, pid) {
+		return nil
+	}
+
+	// Signal the whole session, the run script is a wrapper around qemu.
+	err := syscall.Kill(-pid, syscall.SIGTERM)
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(pid, 0) != nil {
+			return os.Remove(cfg.pidFile())
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	err = syscall.Kill(-pid, syscall.SIGKILL)
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+
+	return os.Remove(cfg.pidFile())
+}
@@ -0,0 +1,66 @@
+package nix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveVMState(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		otherFile bool
+	}{
+		{"only vm files", false},
+		{"shared directory", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "vm-state")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			cfg := &VMConfig{StateDir: filepath.Join(dir, "state")}
+			err = os.MkdirAll(filepath.Join(cfg.StateDir, "nix-vm.abc123", "xchg"), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range []string{cfg.pidFile(), cfg.logFile(), cfg.diskImage()} {
+				err = ioutil.WriteFile(path, nil, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			other := filepath.Join(cfg.StateDir, "unrelated")
+			if tc.otherFile {
+				err = ioutil.WriteFile(other, []byte("keep me"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = RemoveVMState(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.otherFile {
+				if _, err := os.Stat(cfg.StateDir); !os.IsNotExist(err) {
+					t.Fatalf("state dir was not removed: %v", err)
+				}
+				return
+			}
+
+			if _, err := os.Stat(other); err != nil {
+				t.Fatalf("unrelated file was removed: %s", err)
+			}
+			entries, _ := ioutil.ReadDir(cfg.StateDir)
+			if len(entries) != 1 {
+				t.Fatalf("vm files were left behind: %v", entries)
+			}
+		})
+	}
+}
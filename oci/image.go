@@ -0,0 +1,436 @@
+// Package oci reads container images produced by nix and pushes them to
+// registries implementing the OCI distribution API.
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Media types used in the manifests we produce or accept.
+const (
+	MediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// Descriptor references a blob by digest, as in a manifest.
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Image is a container image with all blobs available on local disk.
+type Image struct {
+	Manifest          []byte
+	ManifestMediaType string
+	ManifestDigest    string
+	Config            Descriptor
+	Layers            []Descriptor
+	// RepoTags are the tags recorded in a docker archive, if any.
+	RepoTags []string
+
+	blobs   map[string]string
+	tempDir string
+}
+
+// Open returns the contents of a blob referenced by the image.
+func (img *Image) Open(digest string) (io.ReadCloser, error) {
+	path, ok := img.blobs[digest]
+	if !ok {
+		return nil, fmt.Errorf("image has no blob %s", digest)
+	}
+	return os.Open(path)
+}
+
+// Close removes any temporary files backing the image.
+func (img *Image) Close() error {
+	if img.tempDir == "" {
+		return nil
+	}
+	return os.RemoveAll(img.tempDir)
+}
+
+func digestBytes(b []byte) string {
+	h := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+func digestFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// Load reads an image from a docker archive, as produced by dockerTools.buildImage,
+// or from an OCI image layout. Either may be a directory, a tarball or a gzipped tarball.
+func Load(path string) (*Image, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		blobs: make(map[string]string),
+	}
+
+	dir := path
+	if !info.IsDir() {
+		img.tempDir, err = ioutil.TempDir("", "")
+		if err != nil {
+			return nil, err
+		}
+		err = extract(path, img.tempDir)
+		if err != nil {
+			_ = img.Close()
+			return nil, err
+		}
+		dir = img.tempDir
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		err = img.loadLayout(dir)
+	} else if _, err = os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		err = img.loadDockerArchive(dir)
+	} else {
+		err = errors.New("not a docker archive or oci image layout")
+	}
+	if err != nil {
+		_ = img.Close()
+		return nil, fmt.Errorf("loading image %s failed: %s", path, err)
+	}
+
+	return img, nil
+}
+
+func extract(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	magic, err := r.(*bufio.Reader).Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// Links are made after everything else is extracted, as hard links, so
+	// no symlink on disk can lead a later entry or a blob read outside dir.
+	var links []archiveLink
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return extractLinks(links)
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return fmt.Errorf("archive entry %s escapes the archive", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				err = writeFile(target, tr)
+			}
+		case tar.TypeSymlink:
+			// Docker archives link duplicate layers to each other, links
+			// anywhere else would let blobs be read from outside the archive.
+			source := filepath.Join(filepath.Dir(target), hdr.Linkname)
+			if filepath.IsAbs(hdr.Linkname) || !within(dir, source) {
+				return fmt.Errorf("archive entry %s links outside the archive", hdr.Name)
+			}
+			links = append(links, archiveLink{name: hdr.Name, source: source, target: target})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type archiveLink struct {
+	name, source, target string
+}
+
+// extractLinks hard links each target to its source, which may itself be
+// the target of another link.
+func extractLinks(links []archiveLink) error {
+	for len(links) != 0 {
+		var pending []archiveLink
+		for _, link := range links {
+			info, err := os.Lstat(link.source)
+			if err != nil || !info.Mode().IsRegular() {
+				pending = append(pending, link)
+				continue
+			}
+			err = os.MkdirAll(filepath.Dir(link.target), 0755)
+			if err == nil {
+				err = os.Link(link.source, link.target)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(pending) == len(links) {
+			return fmt.Errorf("archive entry %s does not link to a file in the archive", pending[0].name)
+		}
+		links = pending
+	}
+	return nil
+}
+
+// within reports if path is dir or under it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (img *Image) addBlob(path, mediaType string) (Descriptor, error) {
+	digest, size, err := digestFile(path)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	img.blobs[digest] = path
+	return Descriptor{MediaType: mediaType, Digest: digest, Size: size}, nil
+}
+
+func (img *Image) loadLayout(dir string) error {
+	var index struct {
+		Manifests []Descriptor `json:"manifests"`
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, &index)
+	if err != nil {
+		return err
+	}
+	if len(index.Manifests) != 1 {
+		return fmt.Errorf("expected exactly one manifest in index.json, found %d", len(index.Manifests))
+	}
+
+	blobPath := func(digest string) (string, error) {
+		parts := strings.SplitN(digest, ":", 2)
+		if len(parts) != 2 || strings.ContainsAny(parts[1], "/.") {
+			return "", fmt.Errorf("invalid digest %q", digest)
+		}
+		return filepath.Join(dir, "blobs", parts[0], parts[1]), nil
+	}
+
+	manifestPath, err := blobPath(index.Manifests[0].Digest)
+	if err != nil {
+		return err
+	}
+	img.Manifest, err = ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	img.ManifestDigest = digestBytes(img.Manifest)
+	if img.ManifestDigest != index.Manifests[0].Digest {
+		return fmt.Errorf("manifest digest mismatch, expected %s got %s", index.Manifests[0].Digest, img.ManifestDigest)
+	}
+	img.ManifestMediaType = index.Manifests[0].MediaType
+	if img.ManifestMediaType == "" {
+		img.ManifestMediaType = MediaTypeManifest
+	}
+
+	var m manifest
+	err = json.Unmarshal(img.Manifest, &m)
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range append([]Descriptor{m.Config}, m.Layers...) {
+		p, err := blobPath(desc.Digest)
+		if err != nil {
+			return err
+		}
+		loaded, err := img.addBlob(p, desc.MediaType)
+		if err != nil {
+			return err
+		}
+		if loaded.Digest != desc.Digest {
+			return fmt.Errorf("blob digest mismatch, expected %s got %s", desc.Digest, loaded.Digest)
+		}
+	}
+
+	img.Config = m.Config
+	img.Layers = m.Layers
+
+	return nil
+}
+
+func (img *Image) loadDockerArchive(dir string) error {
+	var entries []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, &entries)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 {
+		return fmt.Errorf("expected exactly one image in manifest.json, found %d", len(entries))
+	}
+	entry := entries[0]
+	img.RepoTags = entry.RepoTags
+
+	archivePath := func(name string) (string, error) {
+		path := filepath.Join(dir, filepath.Clean(name))
+		if !within(dir, path) {
+			return "", fmt.Errorf("manifest.json refers to %s outside the archive", name)
+		}
+		return path, nil
+	}
+
+	configPath, err := archivePath(entry.Config)
+	if err != nil {
+		return err
+	}
+	img.Config, err = img.addBlob(configPath, MediaTypeConfig)
+	if err != nil {
+		return err
+	}
+
+	// The compressed layers are written to our own temporary directory, an
+	// archive given as a directory may be read only, such as in the nix store.
+	if img.tempDir == "" {
+		img.tempDir, err = ioutil.TempDir("", "")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Docker archives hold uncompressed layers, registries expect them compressed.
+	for i, layer := range entry.Layers {
+		layerPath, err := archivePath(layer)
+		if err != nil {
+			return err
+		}
+		compressed := filepath.Join(img.tempDir, fmt.Sprintf("layer-%d.tar.gz", i))
+		err = gzipFile(layerPath, compressed)
+		if err != nil {
+			return err
+		}
+		desc, err := img.addBlob(compressed, MediaTypeLayerGzip)
+		if err != nil {
+			return err
+		}
+		img.Layers = append(img.Layers, desc)
+	}
+
+	img.ManifestMediaType = MediaTypeManifest
+	img.Manifest, err = json.Marshal(manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        img.Config,
+		Layers:        img.Layers,
+	})
+	if err != nil {
+		return err
+	}
+	img.ManifestDigest = digestBytes(img.Manifest)
+
+	return nil
+}
+
+// gzipFile compresses src to dst. The output only depends on the input, so
+// digests are reproducible.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,340 @@
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	body     string
+	linkname string
+}
+
+func writeTar(t *testing.T, path string, entries []tarEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.linkname != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.linkname
+			hdr.Size = 0
+		}
+		err = tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write([]byte(e.body))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "oci-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func readBlob(t *testing.T, img *Image, digest string) string {
+	rc, err := img.Open(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLoadDockerArchive(t *testing.T) {
+	dir := tempDir(t)
+	config := `{"architecture":"amd64","os":"linux"}`
+
+	// The second layer is a duplicate of the first, linked as docker save does.
+	path := filepath.Join(dir, "image.tar")
+	writeTar(t, path, []tarEntry{
+		{name: "manifest.json", body: mustJSON(t, []map[string]interface{}{{
+			"Config":   "config.json",
+			"RepoTags": []string{"app:latest"},
+			"Layers":   []string{"aaa/layer.tar", "bbb/layer.tar"},
+		}})},
+		{name: "config.json", body: config},
+		{name: "bbb/layer.tar", linkname: "../aaa/layer.tar"},
+		{name: "aaa/layer.tar", body: "layer contents"},
+	})
+
+	img, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	if img.Config.Digest != digestBytes([]byte(config)) || img.Config.MediaType != MediaTypeConfig {
+		t.Fatalf("unexpected config %+v", img.Config)
+	}
+	if len(img.RepoTags) != 1 || img.RepoTags[0] != "app:latest" {
+		t.Fatalf("unexpected repo tags %v", img.RepoTags)
+	}
+	if len(img.Layers) != 2 || img.Layers[0].Digest != img.Layers[1].Digest {
+		t.Fatalf("unexpected layers %+v", img.Layers)
+	}
+	if img.Layers[0].MediaType != MediaTypeLayerGzip {
+		t.Fatalf("unexpected layer media type %s", img.Layers[0].MediaType)
+	}
+	if readBlob(t, img, img.Config.Digest) != config {
+		t.Fatal("config blob does not match the archive")
+	}
+	if img.ManifestDigest != digestBytes(img.Manifest) {
+		t.Fatal("manifest digest does not match the manifest")
+	}
+
+	var m manifest
+	err = json.Unmarshal(img.Manifest, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Config != img.Config || len(m.Layers) != 2 || m.Layers[0] != img.Layers[0] {
+		t.Fatalf("manifest does not reference the image blobs: %s", img.Manifest)
+	}
+}
+
+func TestLoadLayout(t *testing.T) {
+	dir := tempDir(t)
+	config := `{"architecture":"arm64","os":"linux"}`
+	layer := "compressed layer"
+
+	configDesc := Descriptor{MediaType: MediaTypeConfig, Digest: digestBytes([]byte(config)), Size: int64(len(config))}
+	layerDesc := Descriptor{MediaType: MediaTypeLayerGzip, Digest: digestBytes([]byte(layer)), Size: int64(len(layer))}
+	m := mustJSON(t, manifest{SchemaVersion: 2, MediaType: MediaTypeManifest, Config: configDesc, Layers: []Descriptor{layerDesc}})
+	manifestDigest := digestBytes([]byte(m))
+
+	blob := func(digest string) string {
+		return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+	}
+	entries := []tarEntry{
+		{name: "oci-layout", body: `{"imageLayoutVersion":"1.0.0"}`},
+		{name: "index.json", body: mustJSON(t, map[string]interface{}{
+			"schemaVersion": 2,
+			"manifests":     []Descriptor{{MediaType: MediaTypeManifest, Digest: manifestDigest, Size: int64(len(m))}},
+		})},
+		{name: blob(manifestDigest), body: m},
+		{name: blob(configDesc.Digest), body: config},
+		{name: blob(layerDesc.Digest), body: layer},
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		path := filepath.Join(dir, "valid.tar")
+		writeTar(t, path, entries)
+
+		img, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+
+		if img.ManifestDigest != manifestDigest || string(img.Manifest) != m || img.ManifestMediaType != MediaTypeManifest {
+			t.Fatalf("unexpected manifest %s %s", img.ManifestDigest, img.Manifest)
+		}
+		if img.Config != configDesc || len(img.Layers) != 1 || img.Layers[0] != layerDesc {
+			t.Fatalf("unexpected blobs %+v %+v", img.Config, img.Layers)
+		}
+		if readBlob(t, img, layerDesc.Digest) != layer {
+			t.Fatal("layer blob does not match the layout")
+		}
+	})
+
+	t.Run("corrupt blob", func(t *testing.T) {
+		path := filepath.Join(dir, "corrupt.tar")
+		corrupt := append([]tarEntry(nil), entries...)
+		corrupt[4].body = "tampered layer"
+		writeTar(t, path, corrupt)
+
+		_, err := Load(path)
+		if err == nil || !strings.Contains(err.Error(), "blob digest mismatch") {
+			t.Fatalf("got error %v, want a digest mismatch", err)
+		}
+	})
+}
+
+func TestLoadRejectsEscapes(t *testing.T) {
+	outside := tempDir(t)
+	secret := filepath.Join(outside, "secret")
+	err := ioutil.WriteFile(secret, []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		wantErr string
+	}{
+		{
+			name:    "parent path",
+			entries: []tarEntry{{name: "../evil", body: "x"}},
+			wantErr: "escapes the archive",
+		},
+		{
+			name:    "absolute link",
+			entries: []tarEntry{{name: "config.json", linkname: secret}},
+			wantErr: "links outside the archive",
+		},
+		{
+			name:    "relative link",
+			entries: []tarEntry{{name: "aaa/layer.tar", linkname: "../../../../../../../../" + secret}},
+			wantErr: "links outside the archive",
+		},
+		{
+			// Once d links to the archive root, d/.. would be outside it.
+			name: "link through a link",
+			entries: []tarEntry{
+				{name: "d", linkname: "."},
+				{name: "config.json", linkname: "d/../" + filepath.Base(outside) + "/secret"},
+			},
+			wantErr: "does not link to a file in the archive",
+		},
+		{
+			name:    "dangling link",
+			entries: []tarEntry{{name: "config.json", linkname: "missing.json"}},
+			wantErr: "does not link to a file in the archive",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(tempDir(t), "image.tar")
+			writeTar(t, path, tc.entries)
+
+			dir := tempDir(t)
+			err := extract(path, dir)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestLoadDockerArchiveDirectory checks loading an unpacked archive, such as
+// one in the nix store, leaves it untouched.
+func TestLoadDockerArchiveDirectory(t *testing.T) {
+	dir := tempDir(t)
+	archive := filepath.Join(dir, "archive")
+	files := map[string]string{
+		"manifest.json": mustJSON(t, []map[string]interface{}{{
+			"Config": "config.json",
+			"Layers": []string{"aaa/layer.tar"},
+		}}),
+		"config.json":   `{"architecture":"amd64","os":"linux"}`,
+		"aaa/layer.tar": "layer contents",
+	}
+	for name, body := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(archive, name)), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(archive, name), []byte(body), 0444)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	img, err := Load(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Layers) != 1 || readBlob(t, img, img.Layers[0].Digest) == "" {
+		t.Fatalf("unexpected layers %+v", img.Layers)
+	}
+
+	var written []string
+	err = filepath.Walk(archive, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(archive, path)
+			if _, ok := files[filepath.ToSlash(rel)]; !ok {
+				written = append(written, rel)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 0 {
+		t.Fatalf("loading wrote %v into the archive", written)
+	}
+
+	tempDir := img.tempDir
+	err = img.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tempDir); !os.IsNotExist(err) {
+		t.Fatalf("compressed layers were left behind: %v", err)
+	}
+}
+
+func TestLoadDockerArchiveRejectsEscapes(t *testing.T) {
+	// The archive is next to the secret, so a relative path reaches it.
+	outside := tempDir(t)
+	archive := outside + "-archive"
+	err := os.Mkdir(archive, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archive)
+
+	for name, body := range map[string]string{
+		filepath.Join(outside, "secret"):      "secret",
+		filepath.Join(archive, "config.json"): "{}",
+		filepath.Join(archive, "layer.tar"):   "layer contents",
+	} {
+		err = ioutil.WriteFile(name, []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	escape := "../" + filepath.Base(outside) + "/secret"
+	for _, entry := range []map[string]interface{}{
+		{"Config": escape, "Layers": []string{"layer.tar"}},
+		{"Config": "config.json", "Layers": []string{escape}},
+	} {
+		err = ioutil.WriteFile(filepath.Join(archive, "manifest.json"), []byte(mustJSON(t, []map[string]interface{}{entry})), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = Load(archive)
+		if err == nil || !strings.Contains(err.Error(), "outside the archive") {
+			t.Fatalf("got error %v, want manifest.json %v rejected", err, entry)
+		}
+	}
+}
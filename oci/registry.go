@@ -0,0 +1,281 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Registry is a client for the OCI distribution API of a single registry.
+type Registry struct {
+	// Host of the registry, including the port if any.
+	Host     string
+	Insecure bool
+	Username string
+	Password string
+
+	Client *http.Client
+
+	token string
+}
+
+// ParseReference splits a repository reference such as
+// registry.example.com/team/app into its registry host and repository name.
+// References without a registry refer to docker hub.
+func ParseReference(ref string) (string, string) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0], parts[1]
+	}
+	if len(parts) == 1 {
+		return "registry-1.docker.io", "library/" + ref
+	}
+	return "registry-1.docker.io", ref
+}
+
+func (r *Registry) baseURL() string {
+	scheme := "https"
+	if r.Insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+func (r *Registry) client() *http.Client {
+	if r.Client != nil {
+		return r.Client
+	}
+	return http.DefaultClient
+}
+
+// do performs a request, authenticating and retrying if the registry asks for it.
+// body may be nil, otherwise it is called for each attempt.
+func (r *Registry) do(method, u string, header http.Header, body func() (io.ReadCloser, int64, error)) (*http.Response, error) {
+	attempt := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if body != nil {
+			rc, size, err := body()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = rc
+			req.ContentLength = size
+		}
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		} else if r.Username != "" {
+			req.SetBasicAuth(r.Username, r.Password)
+		}
+		return r.client().Do(req)
+	}
+
+	resp, err := attempt()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	_ = resp.Body.Close()
+
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return nil, fmt.Errorf("%s %s: unauthorized", method, u)
+	}
+
+	err = r.fetchToken(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return attempt()
+}
+
+// fetchToken exchanges our credentials for a bearer token, following a
+// WWW-Authenticate challenge as described by the docker token auth spec.
+func (r *Registry) fetchToken(challenge string) error {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(challenge[len("bearer "):], ",") {
+		idx := strings.Index(kv, "=")
+		if idx < 0 {
+			continue
+		}
+		params[strings.TrimSpace(kv[:idx])] = strings.Trim(strings.TrimSpace(kv[idx+1:]), "\"")
+	}
+
+	realm, ok := params["realm"]
+	if !ok {
+		return fmt.Errorf("registry auth challenge has no realm: %s", challenge)
+	}
+
+	q := url.Values{}
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	if scope, ok := params["scope"]; ok {
+		q.Set("scope", scope)
+	}
+
+	req, err := http.NewRequest("GET", realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if r.Username != "" {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry token request failed: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return err
+	}
+
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return fmt.Errorf("registry token response from %s has no token", realm)
+	}
+
+	return nil
+}
+
+func responseError(resp *http.Response, what string) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	return fmt.Errorf("%s failed: %s: %s", what, resp.Status, strings.TrimSpace(string(b)))
+}
+
+// BlobExists reports if the repository already has a blob.
+func (r *Registry) BlobExists(name, digest string) (bool, error) {
+	resp, err := r.do("HEAD", fmt.Sprintf("%s/v2/%s/blobs/%s", r.baseURL(), name, digest), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError(resp, "checking blob "+digest)
+	}
+}
+
+// PushBlob uploads a blob to the repository in a single request.
+func (r *Registry) PushBlob(name string, desc Descriptor, open func() (io.ReadCloser, error)) error {
+	resp, err := r.do("POST", fmt.Sprintf("%s/v2/%s/blobs/uploads/", r.baseURL(), name), nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		err = responseError(resp, "starting upload of "+desc.Digest)
+		resp.Body.Close()
+		return err
+	}
+	resp.Body.Close()
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	q := location.Query()
+	q.Set("digest", desc.Digest)
+	location.RawQuery = q.Encode()
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+
+	resp, err = r.do("PUT", location.String(), header, func() (io.ReadCloser, int64, error) {
+		rc, err := open()
+		return rc, desc.Size, err
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp, "uploading "+desc.Digest)
+	}
+
+	return nil
+}
+
+// PushManifest uploads a manifest, tagging it with reference.
+func (r *Registry) PushManifest(name, reference, mediaType string, manifest []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", mediaType)
+
+	resp, err := r.do("PUT", fmt.Sprintf("%s/v2/%s/manifests/%s", r.baseURL(), name, reference), header, func() (io.ReadCloser, int64, error) {
+		return ioutil.NopCloser(bytes.NewReader(manifest)), int64(len(manifest)), nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp, "pushing manifest "+reference)
+	}
+
+	return nil
+}
+
+// Push uploads an image to the repository under each tag, skipping blobs
+// the registry already has.
+func (r *Registry) Push(name string, img *Image, tags []string) error {
+	for _, desc := range append([]Descriptor{img.Config}, img.Layers...) {
+		exists, err := r.BlobExists(name, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		digest := desc.Digest
+		err = r.PushBlob(name, desc, func() (io.ReadCloser, error) {
+			return img.Open(digest)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range tags {
+		err := r.PushManifest(name, tag, img.ManifestMediaType, img.Manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
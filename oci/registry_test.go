@@ -0,0 +1,182 @@
+package oci
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is an in-memory registry that only accepts requests with a
+// bearer token, issued for the basic auth credentials user:pass.
+type testRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string]string
+	manifests map[string]string
+	requests  []string
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	reg := &testRegistry{
+		blobs:     make(map[string]string),
+		manifests: make(map[string]string),
+	}
+	reg.Server = httptest.NewServer(http.HandlerFunc(reg.serve))
+	t.Cleanup(reg.Close)
+	return reg
+}
+
+func (reg *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		user, pass, _ := req.BasicAuth()
+		if user != "user" || pass != "pass" || req.URL.Query().Get("service") != "test" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token":"secret-token"}`)
+		return
+	}
+
+	reg.requests = append(reg.requests, req.Method+" "+req.URL.Path)
+
+	if req.Header.Get("Authorization") != "Bearer secret-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:app:push,pull"`, reg.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const prefix = "/v2/app/"
+	path := strings.TrimPrefix(req.URL.Path, prefix)
+	switch {
+	case req.Method == "HEAD" && strings.HasPrefix(path, "blobs/"):
+		if _, ok := reg.blobs[strings.TrimPrefix(path, "blobs/")]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case req.Method == "POST" && path == "blobs/uploads/":
+		w.Header().Set("Location", prefix+"blobs/uploads/1?state=abc")
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == "PUT" && path == "blobs/uploads/1":
+		b, _ := ioutil.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if req.URL.Query().Get("state") != "abc" || digest != digestBytes(b) {
+			http.Error(w, "bad upload", http.StatusBadRequest)
+			return
+		}
+		reg.blobs[digest] = string(b)
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == "PUT" && strings.HasPrefix(path, "manifests/"):
+		b, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("Content-Type") != MediaTypeManifest {
+			http.Error(w, "unsupported manifest type", http.StatusUnsupportedMediaType)
+			return
+		}
+		reg.manifests[strings.TrimPrefix(path, "manifests/")] = string(b)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (reg *testRegistry) client(password string) *Registry {
+	return &Registry{
+		Host:     strings.TrimPrefix(reg.URL, "http://"),
+		Insecure: true,
+		Username: "user",
+		Password: password,
+	}
+}
+
+func TestRegistryPush(t *testing.T) {
+	reg := newTestRegistry(t)
+
+	config := `{"os":"linux"}`
+	layer := "layer"
+	img := &Image{
+		Manifest:          []byte(`{"schemaVersion":2}`),
+		ManifestMediaType: MediaTypeManifest,
+		Config:            Descriptor{MediaType: MediaTypeConfig, Digest: digestBytes([]byte(config)), Size: int64(len(config))},
+		Layers:            []Descriptor{{MediaType: MediaTypeLayerGzip, Digest: digestBytes([]byte(layer)), Size: int64(len(layer))}},
+		blobs:             make(map[string]string),
+	}
+	dir := tempDir(t)
+	for name, body := range map[string]string{"config": config, "layer": layer} {
+		path := dir + "/" + name
+		err := ioutil.WriteFile(path, []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.blobs[digestBytes([]byte(body))] = path
+	}
+
+	// The registry already has the layer.
+	reg.blobs[img.Layers[0].Digest] = layer
+
+	r := reg.client("pass")
+	err := r.Push("app", img, []string{"v1", "latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.blobs[img.Config.Digest] != config {
+		t.Fatalf("config was not uploaded: %v", reg.blobs)
+	}
+	for _, tag := range []string{"v1", "latest"} {
+		if reg.manifests[tag] != string(img.Manifest) {
+			t.Fatalf("manifest was not pushed as %s: %v", tag, reg.manifests)
+		}
+	}
+
+	// Only the first request is challenged, the token is reused after it.
+	want := []string{
+		"HEAD /v2/app/blobs/" + img.Config.Digest,
+		"HEAD /v2/app/blobs/" + img.Config.Digest,
+		"POST /v2/app/blobs/uploads/",
+		"PUT /v2/app/blobs/uploads/1",
+		"HEAD /v2/app/blobs/" + img.Layers[0].Digest,
+		"PUT /v2/app/manifests/v1",
+		"PUT /v2/app/manifests/latest",
+	}
+	if strings.Join(reg.requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got requests:\n%s\nwant:\n%s", strings.Join(reg.requests, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	reg := newTestRegistry(t)
+
+	_, err := reg.client("wrong").BlobExists("app", digestBytes(nil))
+	if err == nil || !strings.Contains(err.Error(), "registry token request failed: 403") {
+		t.Fatalf("got error %v, want a failed token request", err)
+	}
+
+	r := reg.client("pass")
+	desc := Descriptor{Digest: digestBytes([]byte("a")), Size: 1}
+	err = r.PushBlob("app", desc, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("b")), nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "uploading "+desc.Digest+" failed: 400 Bad Request: bad upload") {
+		t.Fatalf("got error %v, want the registry's response", err)
+	}
+
+	// The upload can't start in another repository, the body explains why.
+	err = r.PushBlob("other", desc, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("a")), nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "starting upload of "+desc.Digest+" failed: 404 Not Found: not found") {
+		t.Fatalf("got error %v, want the registry's response", err)
+	}
+
+	err = r.PushManifest("app", "v1", "application/json", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "pushing manifest v1 failed: 415") {
+		t.Fatalf("got error %v, want an unsupported media type", err)
+	}
+}
@@ -3,23 +3,58 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"os"
 
+	"github.com/andrewchambers/terraform-provider-nix/nix"
 	"github.com/hashicorp/terraform/helper/schema"
 )
 
 // Provider creates the root nix terraform provider.
 func Provider() *schema.Provider {
 	return &schema.Provider{
+		Schema: map[string]*schema.Schema{
+			"builders": buildersSchema(),
+			"log_dir":  logDirSchema(),
+		},
+		ConfigureFunc: providerConfigure,
 		DataSourcesMap: map[string]*schema.Resource{
-			"nix_build": dataSourceNixBuild(),
+			"nix_build":       dataSourceNixBuild(),
+			"nix_disk_layout": dataSourceDiskLayout(),
+			"nix_nixos_host":  dataSourceNixOSHost(),
 		},
 		ResourcesMap: map[string]*schema.Resource{
-			"nix_nixos": resourceNixOS(),
-			"nix_build": resourceNixBuild(),
+			"nix_nixos":           resourceNixOS(),
+			"nix_build":           resourceNixBuild(),
+			"nix_nixos_install":   resourceNixOSInstall(),
+			"nix_nixos_image":     resourceNixOSImage(),
+			"nix_nixos_vm":        resourceNixOSVM(),
+			"nix_nixos_test":      resourceNixOSTest(),
+			"nix_oci_image":       resourceOCIImage(),
+			"nix_cache_push":      resourceCachePush(),
+			"nix_copy_closure":    resourceCopyClosure(),
+			"nix_profile":         resourceProfile(),
+			"nix_systemd_units":   resourceSystemdUnits(),
+			"nix_home_manager":    resourceHomeManager(),
+			"nix_nixos_container": resourceNixOSContainer(),
 		},
 	}
 }
 
+// providerConfig is passed to resources as their meta.
+type providerConfig struct {
+	// Builders are used by resources that set none of their own.
+	Builders nix.Builders
+	// LogDir is used by resources that set no log_dir of their own.
+	LogDir string
+}
+
+func providerConfigure(d *schema.ResourceData) (interface{}, error) {
+	return &providerConfig{
+		Builders: expandBuilders(d.Get("builders").([]interface{})),
+		LogDir:   d.Get("log_dir").(string),
+	}, nil
+}
+
 func randomID() string {
 	b := make([]byte, 32, 32)
 	_, err := rand.Read(b)
@@ -29,6 +64,19 @@ func randomID() string {
 	return hex.EncodeToString(b)
 }
 
+// writeManagedFile writes contents to path, for expressions and configs under terraform control.
+func writeManagedFile(path, contents string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(contents))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 type resourceLike interface {
 	GetOk(string) (interface{}, bool)
 	Get(string) interface{}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProvider(t *testing.T) {
+	err := Provider().InternalValidate()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestProviderRegistersResources checks every resource and data source
+// defined in the package is reachable from Provider.
+func TestProviderRegistersResources(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isResource := func(name string) bool {
+		return strings.HasPrefix(name, "resource") || strings.HasPrefix(name, "dataSource")
+	}
+
+	defined := map[string]bool{}
+	registered := map[string]bool{}
+	for _, f := range pkgs["main"].Files {
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			if fn.Recv == nil && isResource(fn.Name.Name) && fn.Type.Params.NumFields() == 0 && fn.Type.Results.NumFields() == 1 {
+				if star, ok := fn.Type.Results.List[0].Type.(*ast.StarExpr); ok {
+					if sel, ok := star.X.(*ast.SelectorExpr); ok && sel.Sel.Name == "Resource" {
+						defined[fn.Name.Name] = true
+					}
+				}
+			}
+			if fn.Name.Name != "Provider" {
+				continue
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				if call, ok := n.(*ast.CallExpr); ok {
+					if ident, ok := call.Fun.(*ast.Ident); ok && isResource(ident.Name) {
+						registered[ident.Name] = true
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	if len(defined) == 0 {
+		t.Fatal("found no resources")
+	}
+	for name := range defined {
+		if !registered[name] {
+			t.Errorf("%s is not registered with the provider", name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// A store path closure uploaded to a binary cache.
+func resourceCachePush() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceCachePushCreateUpdate,
+		Update: resourceCachePushCreateUpdate,
+		Read:   resourceCachePushRead,
+		Delete: resourceCachePushDelete,
+
+		Schema: map[string]*schema.Schema{
+			"store_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"cache_url": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"secret_key": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				Sensitive:     true,
+				ConflictsWith: []string{"secret_key_file"},
+			},
+			"secret_key_file": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"secret_key"},
+			},
+			"uploaded_paths": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+		},
+	}
+}
+
+func resourceCachePushCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	secretKeyFile := d.Get("secret_key_file").(string)
+
+	// Nix only takes keys from files, so write out an inline key for the push.
+	if secretKey, ok := d.GetOk("secret_key"); ok {
+		f, err := ioutil.TempFile("", "")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+
+		_, err = f.Write([]byte(secretKey.(string)))
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+		secretKeyFile = f.Name()
+	}
+
+	uploaded, err := nix.PushToCache(d.Get("cache_url").(string), secretKeyFile, d.Get("store_path").(string))
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("uploaded_paths", uploaded)
+	if err != nil {
+		return err
+	}
+
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	return resourceCachePushRead(d, m)
+}
+
+func resourceCachePushRead(d *schema.ResourceData, m interface{}) error {
+	// Nix uploads dependencies first, so the top level narinfo
+	// is only present once the whole closure is.
+	ok, err := nix.CacheHasPath(d.Get("cache_url").(string), d.Get("store_path").(string))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		d.SetId("")
+	}
+
+	return nil
+}
+
+// Caches are append only, paths are left for garbage collection by the cache owner.
+func resourceCachePushDelete(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
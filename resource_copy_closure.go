@@ -0,0 +1,160 @@
+package main
+
+import (
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// A store path closure copied to a remote nix store and kept alive with a gc root.
+func resourceCopyClosure() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceCopyClosureCreateUpdate,
+		Update: resourceCopyClosureCreateUpdate,
+		Read:   resourceCopyClosureRead,
+		Delete: resourceCopyClosureDelete,
+
+		Schema: map[string]*schema.Schema{
+			"store_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+				ForceNew: true,
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"use_substitutes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compress": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compression": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      nix.CompressionNone,
+				ValidateFunc: validation.StringInSlice([]string{nix.CompressionNone, nix.CompressionGzip, nix.CompressionZstd}, false),
+			},
+			"gc_root_name": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+				ForceNew: true,
+			},
+			"gc_root": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func getCopyClosureConfig(d resourceLike) nix.CopyClosureConfig {
+	return nix.CopyClosureConfig{
+		Target: nix.SSHTarget{
+			User:    d.Get("target_user").(string),
+			Host:    d.Get("target_host").(string),
+			SSHOpts: d.Get("ssh_opts").(string),
+			// Refreshes and plans connect too, they must not hang on an unreachable host.
+			ConnectTimeout: time.Duration(d.Get("ssh_timeout").(int)) * time.Second,
+		},
+		UseSubstitutes: d.Get("use_substitutes").(bool),
+		Compress:       d.Get("compress").(bool),
+		Compression:    d.Get("compression").(string),
+	}
+}
+
+func resourceCopyClosureCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	id := d.Id()
+	if id == "" {
+		id = randomID()
+		d.SetId(id)
+	}
+
+	cfg := getCopyClosureConfig(d)
+	storePath := d.Get("store_path").(string)
+
+	err := nix.WaitForSSH(cfg.Target.User, cfg.Target.Host, cfg.Target.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+
+	err = nix.CopyClosure(&cfg, storePath)
+	if err != nil {
+		return err
+	}
+
+	gcRootName := d.Get("gc_root_name").(string)
+	if gcRootName == "" {
+		gcRootName = "terraform-" + id[:16]
+	}
+
+	gcRoot, err := nix.AddGCRoot(&cfg.Target, gcRootName, storePath)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("gc_root_name", gcRootName)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("gc_root", gcRoot)
+	if err != nil {
+		return err
+	}
+
+	return resourceCopyClosureRead(d, m)
+}
+
+func resourceCopyClosureRead(d *schema.ResourceData, m interface{}) error {
+	cfg := getCopyClosureConfig(d)
+
+	rooted, err := nix.ReadGCRoot(&cfg.Target, d.Get("gc_root").(string))
+	if err != nil {
+		return err
+	}
+
+	// Without the root the closure may be collected at any time.
+	if rooted == "" {
+		d.SetId("")
+		return nil
+	}
+
+	err = d.Set("store_path", rooted)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceCopyClosureDelete(d *schema.ResourceData, m interface{}) error {
+	cfg := getCopyClosureConfig(d)
+
+	// The paths themselves are left for the remote garbage collector.
+	return nix.RemoveGCRoot(&cfg.Target, d.Get("gc_root").(string))
+}
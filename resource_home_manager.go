@@ -0,0 +1,319 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// A home manager configuration for a user on a remote host.
+func resourceHomeManager() *schema.Resource {
+	return &schema.Resource{
+		Create:        resourceHomeManagerCreateUpdate,
+		Update:        resourceHomeManagerCreateUpdate,
+		Read:          resourceHomeManagerRead,
+		Delete:        resourceHomeManagerDelete,
+		CustomizeDiff: resourceHomeManagerCustomizeDiff,
+
+		Schema: map[string]*schema.Schema{
+			"user": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			// Either root, or the user itself.
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+			},
+			"home_config": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"home_config_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"builders": buildersSchema(),
+			"nix_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"use_substitutes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compress": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compression": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      nix.CompressionNone,
+				ValidateFunc: validation.StringInSlice([]string{nix.CompressionNone, nix.CompressionGzip, nix.CompressionZstd}, false),
+			},
+			"pre_switch_hook": &schema.Schema{
+				Type:      schema.TypeString,
+				Optional:  true,
+				Default:   "",
+				Sensitive: true,
+			},
+			"post_switch_hook": &schema.Schema{
+				Type:      schema.TypeString,
+				Optional:  true,
+				Default:   "",
+				Sensitive: true,
+			},
+			"pin_generation": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  0,
+			},
+			"rollback_on_destroy": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"activation_package": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"generation": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"log_dir":       logDirSchema(),
+			"last_log_path": lastLogPathSchema(),
+		},
+	}
+}
+
+func getHomeManagerConfig(d resourceLike, m interface{}) (nix.HomeManagerConfig, error) {
+	nixPath, ok := d.GetOk("nix_path")
+	if !ok {
+		nixPath = os.Getenv("NIX_PATH")
+	}
+
+	configPath, err := filepath.Abs(d.Get("home_config_path").(string))
+	if err != nil {
+		return nix.HomeManagerConfig{}, err
+	}
+
+	cmdLog, err := getCommandLog(d, m)
+	if err != nil {
+		return nix.HomeManagerConfig{}, err
+	}
+
+	return nix.HomeManagerConfig{
+		Target:         getCopyClosureConfig(d).Target,
+		User:           d.Get("user").(string),
+		NixPath:        nixPath.(string),
+		ConfigPath:     configPath,
+		PreSwitchHook:  d.Get("pre_switch_hook").(string),
+		PostSwitchHook: d.Get("post_switch_hook").(string),
+		Builders:       getBuilders(d, m),
+		Log:            cmdLog,
+	}, nil
+}
+
+func buildHomeManager(d resourceLike, cfg *nix.HomeManagerConfig) (string, error) {
+	homeConfig, _ := d.GetOk("home_config")
+	if homeConfig.(string) != "" {
+		err := writeManagedFile(cfg.ConfigPath, homeConfig.(string))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return nix.BuildHomeManager(cfg)
+}
+
+func resourceHomeManagerCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	cfg, err := getHomeManagerConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	// Delete the old config if it was under out control.
+	if d.HasChange("home_config_path") {
+		oldConfig, _ := d.GetChange("home_config")
+		if oldConfig != "" {
+			old, _ := d.GetChange("home_config_path")
+			err := os.Remove(old.(string))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	err = nix.WaitForSSH(cfg.Target.User, cfg.Target.Host, cfg.Target.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+
+	pinGeneration := d.Get("pin_generation").(int)
+	if pinGeneration != 0 {
+		if d.HasChange("pin_generation") || d.HasChange("target_user") {
+			err = nix.HomeManagerSwitchGeneration(&cfg, pinGeneration)
+			if err != nil {
+				return err
+			}
+
+			err = setLastLogPath(d, cfg.Log)
+			if err != nil {
+				return err
+			}
+		}
+		return resourceHomeManagerRead(d, m)
+	}
+
+	activationPackage, err := buildHomeManager(d, &cfg)
+	if err != nil {
+		return err
+	}
+
+	current := d.Get("activation_package").(string)
+	if current != activationPackage || d.HasChange("pin_generation") || d.HasChange("pre_switch_hook") || d.HasChange("post_switch_hook") {
+		copyCfg := getCopyClosureConfig(d)
+		err = nix.CopyClosure(&copyCfg, activationPackage)
+		if err != nil {
+			return err
+		}
+
+		err = nix.ActivateHomeManager(&cfg, activationPackage)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = setLastLogPath(d, cfg.Log)
+	if err != nil {
+		return err
+	}
+
+	return resourceHomeManagerRead(d, m)
+}
+
+func resourceHomeManagerRead(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getHomeManagerConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	activationPackage, generation, err := nix.HomeManagerGeneration(&cfg)
+	if err != nil {
+		return err
+	}
+
+	if activationPackage == "" {
+		d.SetId("")
+		return nil
+	}
+
+	err = d.Set("activation_package", activationPackage)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("generation", generation)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceHomeManagerDelete(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getHomeManagerConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	homeConfig, _ := d.GetOk("home_config")
+	if homeConfig.(string) != "" {
+		err := os.Remove(cfg.ConfigPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if !d.Get("rollback_on_destroy").(bool) {
+		return nil
+	}
+
+	return nix.HomeManagerSwitchGeneration(&cfg, 0)
+}
+
+func resourceHomeManagerCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	// A pinned generation is already on the target, so there is nothing to evaluate.
+	if d.Get("pin_generation").(int) != 0 {
+		if d.HasChange("pin_generation") {
+			d.SetNewComputed("activation_package")
+			d.SetNewComputed("generation")
+			return planLastLogPath(d, m)
+		}
+		return nil
+	}
+
+	// Don't write the config to disk before the first apply.
+	if d.HasChange("home_config") || d.HasChange("pin_generation") {
+		d.SetNewComputed("activation_package")
+		d.SetNewComputed("generation")
+		return planLastLogPath(d, m)
+	}
+
+	cfg, err := getHomeManagerConfig(d, m)
+	if err != nil {
+		return err
+	}
+	// Only applies are logged, or every plan would add a file to log_dir.
+	cfg.Log = nil
+
+	activationPackage, err := buildHomeManager(d, &cfg)
+	if err != nil {
+		log.Printf("build failed, assuming this is because of generated configs. err=%s", err.Error())
+		d.SetNewComputed("activation_package")
+		d.SetNewComputed("generation")
+		return planLastLogPath(d, m)
+	}
+
+	if d.Get("activation_package").(string) != activationPackage {
+		err = d.SetNew("activation_package", activationPackage)
+		if err != nil {
+			return err
+		}
+		d.SetNewComputed("generation")
+		return planLastLogPath(d, m)
+	}
+
+	return nil
+}
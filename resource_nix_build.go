@@ -28,6 +28,7 @@ func resourceNixBuild() *schema.Resource {
 				Type:     schema.TypeString,
 				Required: true,
 			},
+			"builders": buildersSchema(),
 			"nix_path": &schema.Schema{
 				Type:     schema.TypeString,
 				Optional: true,
@@ -40,6 +41,18 @@ func resourceNixBuild() *schema.Resource {
 				Type:     schema.TypeString,
 				Required: true,
 			},
+			"system": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"cross_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"build_host":    buildHostSchema(),
+			"closure_diff":  closureDiffSchema(),
+			"log_dir":       logDirSchema(),
+			"last_log_path": lastLogPathSchema(),
 		},
 	}
 }
@@ -49,6 +62,10 @@ type nixBuildResourceConfig struct {
 	ExpressionPath string
 	NixPath        string
 	OutLink        string
+	BuildHost      *nix.BuildHost
+	Builders       nix.Builders
+	Platform       nix.Platform
+	Log            *nix.CommandLog
 }
 
 func (cfg *nixBuildResourceConfig) DoBuild() (string, error) {
@@ -61,24 +78,24 @@ func (cfg *nixBuildResourceConfig) DoBuildNoLink() (string, error) {
 
 func (cfg *nixBuildResourceConfig) doBuild(outLink *string) (string, error) {
 	if cfg.Expression != "" {
-		f, err := os.Create(cfg.ExpressionPath)
-		if err != nil {
-			return "", err
-		}
-		_, err = f.Write([]byte(cfg.Expression))
+		err := writeManagedFile(cfg.ExpressionPath, cfg.Expression)
 		if err != nil {
 			return "", err
 		}
-		err = f.Close()
-		if err != nil {
-			return "", err
+	}
+
+	if cfg.BuildHost != nil {
+		// Only evaluate for plans, rather than build remotely and fetch the result twice.
+		if outLink == nil {
+			return nix.EvaluateExpressionOn(cfg.BuildHost, cfg.NixPath, cfg.ExpressionPath, cfg.Platform)
 		}
+		return nix.BuildExpressionOn(cfg.BuildHost, cfg.NixPath, cfg.ExpressionPath, outLink, cfg.Platform, cfg.Log)
 	}
 
-	return nix.BuildExpression(cfg.NixPath, cfg.ExpressionPath, outLink)
+	return nix.BuildExpression(cfg.NixPath, cfg.ExpressionPath, outLink, cfg.Builders, cfg.Platform, cfg.Log)
 }
 
-func getBuildConfig(d resourceLike) (nixBuildResourceConfig, error) {
+func getBuildConfig(d resourceLike, m interface{}) (nixBuildResourceConfig, error) {
 
 	nixPath := os.Getenv("NIX_PATH")
 	if p, ok := d.GetOk("nix_path"); ok {
@@ -99,11 +116,20 @@ func getBuildConfig(d resourceLike) (nixBuildResourceConfig, error) {
 		return nixBuildResourceConfig{}, err
 	}
 
+	cmdLog, err := getCommandLog(d, m)
+	if err != nil {
+		return nixBuildResourceConfig{}, err
+	}
+
 	return nixBuildResourceConfig{
 		NixPath:        nixPath,
 		Expression:     expression.(string),
 		ExpressionPath: expressionPath,
 		OutLink:        outLink,
+		BuildHost:      getBuildHost(d),
+		Builders:       getBuilders(d, m),
+		Platform:       getPlatform(d),
+		Log:            cmdLog,
 	}, nil
 }
 
@@ -114,7 +140,7 @@ func resourceNixBuildCreateUpdate(d *schema.ResourceData, m interface{}) error {
 		d.SetId(randomID())
 	}
 
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return err
 	}
@@ -146,10 +172,24 @@ func resourceNixBuildCreateUpdate(d *schema.ResourceData, m interface{}) error {
 	}
 
 	if d.IsNewResource() || d.HasChange("store_path") || !linkExists {
-		_, err = cfg.DoBuild()
+		oldStorePath, _ := d.GetChange("store_path")
+
+		storePath, err := cfg.DoBuild()
+		if err != nil {
+			return err
+		}
+
+		err = setLastLogPath(d, cfg.Log)
 		if err != nil {
 			return err
 		}
+
+		if oldStorePath.(string) != storePath {
+			err = setClosureDiff(d, oldStorePath.(string), storePath)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return resourceNixBuildRead(d, m)
@@ -157,7 +197,7 @@ func resourceNixBuildCreateUpdate(d *schema.ResourceData, m interface{}) error {
 
 func resourceNixBuildRead(d *schema.ResourceData, m interface{}) error {
 
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return err
 	}
@@ -176,7 +216,7 @@ func resourceNixBuildRead(d *schema.ResourceData, m interface{}) error {
 }
 
 func resourceNixBuildDelete(d *schema.ResourceData, m interface{}) error {
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return err
 	}
@@ -197,7 +237,7 @@ func resourceNixBuildDelete(d *schema.ResourceData, m interface{}) error {
 }
 
 func resourceNixBuildExists(d *schema.ResourceData, m interface{}) (bool, error) {
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return false, err
 	}
@@ -218,22 +258,33 @@ func resourceNixBuildCustomizeDiff(d *schema.ResourceDiff, m interface{}) error
 	// when this is the first diff.
 	if d.HasChange("expression") {
 		d.SetNewComputed("store_path")
-		return nil
+		d.SetNewComputed("closure_diff")
+		return planLastLogPath(d, m)
 	}
 
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return err
 	}
+	// Only applies are logged, or every plan would add a file to log_dir.
+	cfg.Log = nil
 
 	desiredBuild, err := cfg.DoBuildNoLink()
 	if err != nil {
 		log.Printf("build failed, assuming this is because of generated expression. err=%s", err.Error())
 		d.SetNewComputed("store_path")
-	} else {
-		if d.Get("store_path").(string) != desiredBuild {
-			d.SetNewComputed("store_path")
+		d.SetNewComputed("closure_diff")
+		return planLastLogPath(d, m)
+	}
+
+	currentBuild := d.Get("store_path").(string)
+	if currentBuild != desiredBuild {
+		d.SetNewComputed("store_path")
+		err = planClosureDiff(d, currentBuild, desiredBuild)
+		if err != nil {
+			return err
 		}
+		return planLastLogPath(d, m)
 	}
 
 	return nil
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// TestResourceNixBuildPlanLog checks builds while planning aren't logged,
+// which would add a file to log_dir for every plan.
+func TestResourceNixBuildPlanLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nix-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const storePath = "/nix/store/aaaa-hello"
+	built := filepath.Join(dir, "built")
+	bin := filepath.Join(dir, "bin")
+	err = os.Mkdir(bin, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(bin, "nix-build"), []byte("#!/bin/sh\ntouch '"+built+"'\necho "+storePath+"\n"), 0755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	logDir := filepath.Join(dir, "logs")
+	config := map[string]interface{}{
+		"expression":      "{ }",
+		"expression_path": filepath.Join(dir, "build.nix"),
+		"out_link":        filepath.Join(dir, "result"),
+		"log_dir":         logDir,
+	}
+	state := &terraform.InstanceState{ID: "build", Attributes: map[string]string{"store_path": storePath, "closure_diff.#": "0"}}
+	for k, v := range config {
+		state.Attributes[k] = v.(string)
+	}
+
+	diff, err := resourceNixBuild().Diff(state, terraform.NewResourceConfigRaw(config), &providerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != nil && len(diff.Attributes) != 0 {
+		t.Fatalf("unexpected diff %v", diff.Attributes)
+	}
+
+	if _, err := os.Stat(built); err != nil {
+		t.Fatalf("the plan did not build: %s", err)
+	}
+	if _, err := os.Stat(logDir); !os.IsNotExist(err) {
+		t.Fatalf("the plan wrote to log_dir: %v", err)
+	}
+}
@@ -1,38 +1,65 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/andrewchambers/terraform-provider-nix/nix"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+	"github.com/zclconf/go-cty/cty"
 )
 
 // A nixos server somewhere in the ether.
 func resourceNixOS() *schema.Resource {
-	return &schema.Resource{
+	r := &schema.Resource{
 		Create:        resourceNixOSCreateUpdate,
 		Update:        resourceNixOSCreateUpdate,
 		Read:          resourceNixOSRead,
 		Delete:        resourceNixOSDelete,
 		CustomizeDiff: resourceNixOSCustomizeDiff,
+		SchemaVersion: 1,
 
 		Schema: map[string]*schema.Schema{
+			// Required by every transport but local, checked in CustomizeDiff.
 			"target_host": &schema.Schema{
 				Type:     schema.TypeString,
-				Required: true,
+				Optional: true,
+			},
+			"use_sudo": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"sudo_password": &schema.Schema{
+				Type:      schema.TypeString,
+				Optional:  true,
+				Default:   "",
+				Sensitive: true,
+			},
+			"transport": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      nix.TransportSSH,
+				ValidateFunc: validation.StringInSlice(nix.Transports, false),
 			},
 			"target_user": &schema.Schema{
 				Type:     schema.TypeString,
 				Optional: true,
 				Default:  "root",
 			},
-			"build_host": &schema.Schema{
+			"build_host": buildHostSchema(),
+			"system": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"cross_system": &schema.Schema{
 				Type:     schema.TypeString,
 				Optional: true,
-				Default:  "localhost",
 			},
 			"nixos_config": &schema.Schema{
 				Type:     schema.TypeString,
@@ -47,6 +74,7 @@ func resourceNixOS() *schema.Resource {
 				Optional: true,
 				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
 			},
+			"builders": buildersSchema(),
 			"nix_path": &schema.Schema{
 				Type:     schema.TypeString,
 				Optional: true,
@@ -77,14 +105,132 @@ func resourceNixOS() *schema.Resource {
 				Default:   "",
 				Sensitive: true,
 			},
+			"pin_generation": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ConflictsWith: []string{"pin_system"},
+			},
+			"pin_system": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"pin_generation"},
+			},
+			"verify_machine_id": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"machine_id": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"closure_diff":  closureDiffSchema(),
+			"log_dir":       logDirSchema(),
+			"last_log_path": lastLogPathSchema(),
+			"generation": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"booted_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"nixos_version": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"kernel_version": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"workspace": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("TF_WORKSPACE", "default"),
+			},
+			"history_size": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  10,
+			},
+			"history": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"system": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"generation": &schema.Schema{
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+						"timestamp": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"workspace": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
 		},
 	}
+
+	r.StateUpgraders = []schema.StateUpgrader{
+		{
+			Version: 0,
+			Type:    resourceNixOSV0Type(r),
+			Upgrade: resourceNixOSUpgradeV0,
+		},
+	}
+
+	return r
+}
+
+// resourceNixOSV0Type is the state of nix_nixos while build_host was a string.
+func resourceNixOSV0Type(r *schema.Resource) cty.Type {
+	v0 := make(map[string]*schema.Schema, len(r.Schema))
+	for k, v := range r.Schema {
+		v0[k] = v
+	}
+	v0["build_host"] = &schema.Schema{
+		Type:     schema.TypeString,
+		Optional: true,
+		Default:  "localhost",
+	}
+	return (&schema.Resource{Schema: v0}).CoreConfigSchema().ImpliedType()
+}
+
+// resourceNixOSUpgradeV0 turns a build_host of user@host into a build_host block.
+func resourceNixOSUpgradeV0(rawState map[string]interface{}, meta interface{}) (map[string]interface{}, error) {
+	buildHost, _ := rawState["build_host"].(string)
+
+	rawState["build_host"] = []interface{}{}
+	if buildHost != "" && buildHost != "localhost" {
+		user := "root"
+		if i := strings.LastIndex(buildHost, "@"); i >= 0 {
+			user = buildHost[:i]
+			buildHost = buildHost[i+1:]
+		}
+		rawState["build_host"] = []interface{}{
+			map[string]interface{}{
+				"host": buildHost,
+				"user": user,
+			},
+		}
+	}
+
+	return rawState, nil
 }
 
 type nixosResourceConfig struct {
 	TargetHost      string
 	TargetUser      string
-	BuildHost       string
+	BuildHost       *nix.BuildHost
 	NixosConfig     string
 	NixosConfigPath string
 	CollectGarbage  bool
@@ -93,6 +239,15 @@ type nixosResourceConfig struct {
 	PreSwitchHook   string
 	PostSwitchHook  string
 	SSHTimeout      time.Duration
+	PinGeneration   int
+	PinSystem       string
+	VerifyMachineID bool
+	Transport       string
+	UseSudo         bool
+	SudoPassword    string
+	Builders        nix.Builders
+	Platform        nix.Platform
+	Log             *nix.CommandLog
 }
 
 func (cfg *nixosResourceConfig) GetRebuildConfig() *nix.NixosRebuildConfig {
@@ -105,23 +260,27 @@ func (cfg *nixosResourceConfig) GetRebuildConfig() *nix.NixosRebuildConfig {
 		SSHOpts:         cfg.SSHOpts,
 		PreSwitchHook:   cfg.PreSwitchHook,
 		PostSwitchHook:  cfg.PostSwitchHook,
+		Transport:       cfg.Transport,
+		UseSudo:         cfg.UseSudo,
+		SudoPassword:    cfg.SudoPassword,
+		Builders:        cfg.Builders,
+		Platform:        cfg.Platform,
+		Log:             cfg.Log,
+		SSHTimeout:      cfg.SSHTimeout,
 	}
 }
 
+func (cfg *nixosResourceConfig) Target() (nix.Transport, error) {
+	return cfg.GetRebuildConfig().Target()
+}
+
+func (cfg *nixosResourceConfig) ElevatedTarget() (nix.Transport, error) {
+	return cfg.GetRebuildConfig().ElevatedTarget()
+}
+
 func (cfg *nixosResourceConfig) writeConfig() error {
 	if cfg.NixosConfig != "" {
-		f, err := os.Create(cfg.NixosConfigPath)
-		if err != nil {
-			return err
-		}
-		_, err = f.Write([]byte(cfg.NixosConfig))
-		if err != nil {
-			return err
-		}
-		err = f.Close()
-		if err != nil {
-			return err
-		}
+		return writeManagedFile(cfg.NixosConfigPath, cfg.NixosConfig)
 	}
 	return nil
 }
@@ -144,11 +303,46 @@ func (cfg *nixosResourceConfig) DoSwitch() error {
 	return nix.SwitchSystem(cfg.GetRebuildConfig())
 }
 
-func (cfg *nixosResourceConfig) CurrentSystem() (string, error) {
-	return nix.CurrentSystem(cfg.GetRebuildConfig())
+// Pinned reports if the host is pinned to an existing system instead of nixos_config_path.
+func (cfg *nixosResourceConfig) Pinned() bool {
+	return cfg.PinGeneration != 0 || cfg.PinSystem != ""
+}
+
+// PinnedSystem resolves the store path of the pinned system on the target.
+func (cfg *nixosResourceConfig) PinnedSystem() (string, error) {
+	if cfg.PinSystem != "" {
+		return cfg.PinSystem, nil
+	}
+	return nix.ResolveGeneration(cfg.GetRebuildConfig(), cfg.PinGeneration)
+}
+
+func (cfg *nixosResourceConfig) DoPinnedSwitch() error {
+	target, err := cfg.Target()
+	if err != nil {
+		return err
+	}
+
+	// Never activate a system the target cannot run.
+	system, err := cfg.PinnedSystem()
+	if err != nil {
+		return err
+	}
+	err = nix.CheckTargetRunsSystem(target, system)
+	if err != nil {
+		return err
+	}
+
+	if cfg.PinSystem != "" {
+		return nix.SwitchToSystem(cfg.GetRebuildConfig(), cfg.PinSystem)
+	}
+	return nix.SwitchGeneration(cfg.GetRebuildConfig(), cfg.PinGeneration)
+}
+
+func (cfg *nixosResourceConfig) SystemInfo() (nix.SystemInfo, error) {
+	return nix.GetSystemInfo(cfg.GetRebuildConfig())
 }
 
-func getNixosConfig(d resourceLike) (nixosResourceConfig, error) {
+func getNixosConfig(d resourceLike, m interface{}) (nixosResourceConfig, error) {
 
 	nixPath, ok := d.GetOk("nix_path")
 	if !ok {
@@ -169,10 +363,21 @@ func getNixosConfig(d resourceLike) (nixosResourceConfig, error) {
 		return nixosResourceConfig{}, err
 	}
 
+	cmdLog, err := getCommandLog(d, m)
+	if err != nil {
+		return nixosResourceConfig{}, err
+	}
+
+	transport := d.Get("transport").(string)
+	targetHost := d.Get("target_host").(string)
+	if transport == nix.TransportLocal && targetHost == "" {
+		targetHost = "localhost"
+	}
+
 	return nixosResourceConfig{
-		TargetHost:      d.Get("target_host").(string),
+		TargetHost:      targetHost,
 		TargetUser:      d.Get("target_user").(string),
-		BuildHost:       d.Get("build_host").(string),
+		BuildHost:       getBuildHost(d),
 		PreSwitchHook:   d.Get("pre_switch_hook").(string),
 		PostSwitchHook:  d.Get("post_switch_hook").(string),
 		NixosConfig:     nixosConfig.(string),
@@ -181,6 +386,15 @@ func getNixosConfig(d resourceLike) (nixosResourceConfig, error) {
 		SSHOpts:         sshOpts.(string),
 		SSHTimeout:      time.Duration(d.Get("ssh_timeout").(int)) * time.Second,
 		CollectGarbage:  d.Get("collect_garbage").(bool),
+		PinGeneration:   d.Get("pin_generation").(int),
+		PinSystem:       d.Get("pin_system").(string),
+		VerifyMachineID: d.Get("verify_machine_id").(bool),
+		Transport:       transport,
+		UseSudo:         d.Get("use_sudo").(bool),
+		SudoPassword:    d.Get("sudo_password").(string),
+		Builders:        getBuilders(d, m),
+		Platform:        getPlatform(d),
+		Log:             cmdLog,
 	}, nil
 }
 
@@ -191,7 +405,7 @@ func resourceNixOSCreateUpdate(d *schema.ResourceData, m interface{}) error {
 		d.SetId(randomID())
 	}
 
-	cfg, err := getNixosConfig(d)
+	cfg, err := getNixosConfig(d, m)
 	if err != nil {
 		return err
 	}
@@ -208,46 +422,146 @@ func resourceNixOSCreateUpdate(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
-	err = nix.WaitForSSH(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.SSHTimeout)
+	target, err := cfg.Target()
+	if err != nil {
+		return err
+	}
+
+	err = nix.WaitForTarget(target, cfg.SSHTimeout)
+	if err != nil {
+		return err
+	}
+
+	machineID, err := nix.MachineID(target)
+	if err != nil {
+		return err
+	}
+
+	// Never switch a machine other than the one we first deployed to,
+	// the address may have been reused by something else entirely.
+	expectedMachineID, _ := d.GetChange("machine_id")
+	if !d.IsNewResource() && cfg.VerifyMachineID && expectedMachineID.(string) != "" && expectedMachineID.(string) != machineID {
+		return fmt.Errorf("refusing to switch %s, its machine id is %s but %s was expected, the host may have been replaced", cfg.TargetHost, machineID, expectedMachineID.(string))
+	}
+
+	err = d.Set("machine_id", machineID)
+	if err != nil {
+		return err
+	}
+
+	// Collecting garbage deletes old generations, which a pinned system may need.
+	if cfg.CollectGarbage && !cfg.Pinned() {
+		elevated, err := cfg.ElevatedTarget()
+		if err != nil {
+			return err
+		}
+
+		err = nix.CollectGarbage(elevated)
+		if err != nil {
+			return err
+		}
+	}
+
+	oldSystem, _ := d.GetChange("nixos_system")
+
+	switched := false
+	if d.HasChange("nixos_system") || d.HasChange("target_host") || d.HasChange("build_host") || d.HasChange("transport") || d.HasChange("pre_switch_hook") || d.HasChange("post_switch_hook") || d.HasChange("pin_generation") || d.HasChange("pin_system") {
+		if cfg.Pinned() {
+			err = cfg.DoPinnedSwitch()
+		} else {
+			// Never activate a system the target cannot run.
+			if hostSystem := cfg.Platform.HostSystem(); hostSystem != "" {
+				err = nix.CheckTargetSystem(target, hostSystem)
+				if err != nil {
+					return err
+				}
+			}
+			err = cfg.DoSwitch()
+		}
+		if err != nil {
+			return err
+		}
+		switched = true
+
+		err = setLastLogPath(d, cfg.Log)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = resourceNixOSRead(d, m)
 	if err != nil {
 		return err
 	}
 
-	if cfg.CollectGarbage {
-		err = nix.CollectGarbage(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts)
+	if switched {
+		err = recordDeployment(d)
 		if err != nil {
 			return err
 		}
 	}
 
-	if d.HasChange("nixos_system") || d.HasChange("target_host") || d.HasChange("pre_switch_hook") || d.HasChange("post_switch_hook") {
-		err = cfg.DoSwitch()
+	newSystem := d.Get("nixos_system").(string)
+	if oldSystem.(string) != newSystem {
+		err = setClosureDiff(d, oldSystem.(string), newSystem)
 		if err != nil {
 			return err
 		}
 	}
 
-	return resourceNixOSRead(d, m)
+	return nil
 }
 
 func resourceNixOSRead(d *schema.ResourceData, m interface{}) error {
 
-	cfg, err := getNixosConfig(d)
+	cfg, err := getNixosConfig(d, m)
 	if err != nil {
 		return err
 	}
 
-	currentSystem := "unknown"
+	info := nix.SystemInfo{
+		CurrentSystem: "unknown",
+	}
+
+	target, err := cfg.Target()
+	if err != nil {
+		return err
+	}
 
-	err = nix.WaitForSSH(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.SSHTimeout)
+	err = nix.WaitForTarget(target, cfg.SSHTimeout)
 	if err == nil {
-		currentSystem, err = cfg.CurrentSystem()
+		info, err = cfg.SystemInfo()
 		if err != nil {
 			return err
 		}
 	}
 
-	err = d.Set("nixos_system", currentSystem)
+	err = d.Set("nixos_system", info.CurrentSystem)
+	if err != nil {
+		return err
+	}
+
+	// Keep the last known values when the host is unreachable.
+	if info.CurrentSystem == "unknown" {
+		return nil
+	}
+
+	err = d.Set("booted_system", info.BootedSystem)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("generation", info.Generation)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("nixos_version", info.NixosVersion)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("kernel_version", info.KernelVersion)
 	if err != nil {
 		return err
 	}
@@ -255,9 +569,34 @@ func resourceNixOSRead(d *schema.ResourceData, m interface{}) error {
 	return nil
 }
 
+// recordDeployment appends the system that was just switched to onto the
+// deployment history, dropping the oldest entries beyond history_size.
+func recordDeployment(d *schema.ResourceData) error {
+	// The plan marks history as computed, so the new value reads as empty.
+	old, _ := d.GetChange("history")
+	history := old.([]interface{})
+
+	history = append(history, map[string]interface{}{
+		"system":     d.Get("nixos_system").(string),
+		"generation": d.Get("generation").(int),
+		"timestamp":  time.Now().UTC().Format(time.RFC3339),
+		"workspace":  d.Get("workspace").(string),
+	})
+
+	historySize := d.Get("history_size").(int)
+	if historySize < 0 {
+		historySize = 0
+	}
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+
+	return d.Set("history", history)
+}
+
 func resourceNixOSDelete(d *schema.ResourceData, m interface{}) error {
 
-	cfg, err := getNixosConfig(d)
+	cfg, err := getNixosConfig(d, m)
 	if err != nil {
 		return err
 	}
@@ -273,29 +612,146 @@ func resourceNixOSDelete(d *schema.ResourceData, m interface{}) error {
 }
 
 func resourceNixOSCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	err := validateTargetHost(d)
+	if err != nil {
+		return err
+	}
+
+	err = validateSudo(d)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := getNixosConfig(d, m)
+	if err != nil {
+		return err
+	}
+	// Only applies are logged, or every plan would add a file to log_dir.
+	cfg.Log = nil
+
+	err = verifyMachineIdentity(d, &cfg)
+	if err != nil {
+		return err
+	}
+
+	// A pinned system is already on the target, so there is nothing to evaluate.
+	// Unknown pins read as unset, so they may still pin the system.
+	pinKnown := d.NewValueKnown("pin_system") && d.NewValueKnown("pin_generation")
+	if cfg.Pinned() || !pinKnown {
+		if !pinKnown || !d.NewValueKnown("target_host") {
+			d.SetNewComputed("closure_diff")
+			return setNixOSSwitchComputed(d, m)
+		}
+
+		pinnedSystem, err := cfg.PinnedSystem()
+		if err != nil {
+			return err
+		}
+
+		currentSystem := d.Get("nixos_system").(string)
+		if currentSystem != pinnedSystem {
+			err = setNixOSSwitchComputed(d, m)
+			if err != nil {
+				return err
+			}
+			return planClosureDiff(d, currentSystem, pinnedSystem)
+		}
+
+		return nil
+	}
+
 	// A trick to prevent prematurely writing nix expressions to disks path
 	// when this is the first diff.
 	if d.HasChange("nixos_config") {
-		d.SetNewComputed("nixos_system")
+		d.SetNewComputed("closure_diff")
+		return setNixOSSwitchComputed(d, m)
+	}
+
+	desiredSystem, err := cfg.DoBuild()
+	if err != nil {
+		log.Printf("build failed, assuming this is because of generated configs. err=%s", err.Error())
+		// If this really is an error, it will be picked up by the switch command.
+		d.SetNewComputed("closure_diff")
+		return setNixOSSwitchComputed(d, m)
+	}
+
+	currentSystem := d.Get("nixos_system").(string)
+	if currentSystem != desiredSystem {
+		err = setNixOSSwitchComputed(d, m)
+		if err != nil {
+			return err
+		}
+		err = planClosureDiff(d, currentSystem, desiredSystem)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateTargetHost requires target_host for every transport but local,
+// so a config missing it can't deploy to the machine running terraform.
+func validateTargetHost(d *schema.ResourceDiff) error {
+	if !d.NewValueKnown("transport") || !d.NewValueKnown("target_host") {
 		return nil
 	}
 
-	cfg, err := getNixosConfig(d)
+	transport := d.Get("transport").(string)
+	if transport == nix.TransportLocal || d.Get("target_host").(string) != "" {
+		return nil
+	}
+
+	return fmt.Errorf("target_host is required with the %s transport", transport)
+}
+
+// validateSudo rejects a sudo_password that would be ignored without use_sudo.
+func validateSudo(d *schema.ResourceDiff) error {
+	if !d.NewValueKnown("use_sudo") || d.Get("use_sudo").(bool) || d.Get("sudo_password").(string) == "" {
+		return nil
+	}
+
+	return fmt.Errorf("sudo_password is only used with use_sudo = true")
+}
+
+// verifyMachineIdentity plans a replacement when the machine answering at
+// target_host is not the one recorded at the first deploy.
+func verifyMachineIdentity(d *schema.ResourceDiff, cfg *nixosResourceConfig) error {
+	expectedMachineID := d.Get("machine_id").(string)
+	if d.Id() == "" || !cfg.VerifyMachineID || expectedMachineID == "" || !d.NewValueKnown("target_host") {
+		return nil
+	}
+
+	target, err := cfg.Target()
 	if err != nil {
 		return err
 	}
 
-	desiredSystem, err := cfg.DoBuild()
+	machineID, err := nix.MachineID(target)
 	if err != nil {
-		log.Printf("build failed, assuming this is because of generated configs. err=%s", err.Error())
-		// If this really is an error, it will be picked up by the switch command.
-		d.SetNewComputed("nixos_system")
+		log.Printf("unable to verify machine id, assuming host is unchanged. err=%s", err.Error())
 		return nil
 	}
 
-	if d.Get("nixos_system").(string) != desiredSystem {
-		d.SetNewComputed("nixos_system")
+	if machineID == expectedMachineID {
+		return nil
 	}
 
-	return nil
+	log.Printf("[WARN] machine id of %s changed from %s to %s, planning replacement", cfg.TargetHost, expectedMachineID, machineID)
+
+	err = d.SetNew("machine_id", machineID)
+	if err != nil {
+		return err
+	}
+
+	return d.ForceNew("machine_id")
+}
+
+// setNixOSSwitchComputed marks the attributes a switch will change.
+func setNixOSSwitchComputed(d *schema.ResourceDiff, m interface{}) error {
+	d.SetNewComputed("nixos_system")
+	d.SetNewComputed("generation")
+	d.SetNewComputed("nixos_version")
+	d.SetNewComputed("history")
+	return planLastLogPath(d, m)
 }
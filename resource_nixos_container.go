@@ -0,0 +1,326 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// A nixos container on a nixos host.
+func resourceNixOSContainer() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceNixOSContainerCreateUpdate,
+		Update: resourceNixOSContainerCreateUpdate,
+		Read:   resourceNixOSContainerRead,
+		Delete: resourceNixOSContainerDelete,
+
+		CustomizeDiff: resourceNixOSContainerCustomizeDiff,
+
+		Schema: map[string]*schema.Schema{
+			// Container names are limited by the length of network interface names.
+			"name": &schema.Schema{
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringLenBetween(1, 11),
+			},
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+			},
+			"nixos_config": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"nixos_config_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"builders": buildersSchema(),
+			"nix_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"use_substitutes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compress": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compression": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      nix.CompressionNone,
+				ValidateFunc: validation.StringInSlice([]string{nix.CompressionNone, nix.CompressionGzip, nix.CompressionZstd}, false),
+			},
+			"host_address": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+			"local_address": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+			"running": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"container_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"ip_address": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"log_dir":       logDirSchema(),
+			"last_log_path": lastLogPathSchema(),
+		},
+	}
+}
+
+type nixosContainerResourceConfig struct {
+	NixosConfig string
+	SSHTimeout  time.Duration
+	Copy        nix.CopyClosureConfig
+	Container   nix.ContainerConfig
+}
+
+func getNixosContainerConfig(d resourceLike, m interface{}) (nixosContainerResourceConfig, error) {
+	nixPath := os.Getenv("NIX_PATH")
+	if p, ok := d.GetOk("nix_path"); ok {
+		nixPath = p.(string)
+	}
+
+	nixosConfig, _ := d.GetOk("nixos_config")
+
+	nixosConfigPath, err := filepath.Abs(d.Get("nixos_config_path").(string))
+	if err != nil {
+		return nixosContainerResourceConfig{}, err
+	}
+
+	copyCfg := getCopyClosureConfig(d)
+
+	cmdLog, err := getCommandLog(d, m)
+	if err != nil {
+		return nixosContainerResourceConfig{}, err
+	}
+
+	return nixosContainerResourceConfig{
+		NixosConfig: nixosConfig.(string),
+		SSHTimeout:  time.Duration(d.Get("ssh_timeout").(int)) * time.Second,
+		Copy:        copyCfg,
+		Container: nix.ContainerConfig{
+			Target:          copyCfg.Target,
+			Name:            d.Get("name").(string),
+			NixPath:         nixPath,
+			NixosConfigPath: nixosConfigPath,
+			HostAddress:     d.Get("host_address").(string),
+			LocalAddress:    d.Get("local_address").(string),
+			Builders:        getBuilders(d, m),
+			Log:             cmdLog,
+		},
+	}, nil
+}
+
+func (cfg *nixosContainerResourceConfig) DoBuild() (string, error) {
+	if cfg.NixosConfig != "" {
+		err := writeManagedFile(cfg.Container.NixosConfigPath, cfg.NixosConfig)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return nix.BuildContainer(&cfg.Container)
+}
+
+func resourceNixOSContainerCreateUpdate(d *schema.ResourceData, m interface{}) error {
+
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	cfg, err := getNixosContainerConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	// Delete the old config if it was under out control.
+	if d.HasChange("nixos_config_path") {
+		oldConfig, _ := d.GetChange("nixos_config")
+		if oldConfig != "" {
+			old, _ := d.GetChange("nixos_config_path")
+			err = os.Remove(old.(string))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	// The build is only logged when the plan expected a new system.
+	if !d.IsNewResource() && !d.HasChange("container_system") {
+		cfg.Container.Log = nil
+	}
+
+	system, err := cfg.DoBuild()
+	if err != nil {
+		return err
+	}
+
+	err = setLastLogPath(d, cfg.Container.Log)
+	if err != nil {
+		return err
+	}
+
+	err = nix.WaitForSSH(cfg.Container.Target.User, cfg.Container.Target.Host, cfg.Container.Target.SSHOpts, cfg.SSHTimeout)
+	if err != nil {
+		return err
+	}
+
+	state, err := nix.ReadContainer(&cfg.Container)
+	if err != nil {
+		return err
+	}
+
+	if !state.Exists || state.System != system {
+		err = nix.CopyClosure(&cfg.Copy, system)
+		if err != nil {
+			return err
+		}
+
+		if state.Exists {
+			err = nix.UpdateContainer(&cfg.Container, system)
+		} else {
+			err = nix.CreateContainer(&cfg.Container, system)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	running := d.Get("running").(bool)
+	if running && !state.Running {
+		err = nix.StartContainer(&cfg.Container)
+	} else if !running && state.Running {
+		err = nix.StopContainer(&cfg.Container)
+	}
+	if err != nil {
+		return err
+	}
+
+	return resourceNixOSContainerRead(d, m)
+}
+
+func resourceNixOSContainerRead(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixosContainerConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	state, err := nix.ReadContainer(&cfg.Container)
+	if err != nil {
+		return err
+	}
+
+	if !state.Exists {
+		d.SetId("")
+		return nil
+	}
+
+	err = d.Set("container_system", state.System)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("running", state.Running)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("ip_address", state.IP)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceNixOSContainerDelete(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixosContainerConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	err = nix.DestroyContainer(&cfg.Container)
+	if err != nil {
+		return err
+	}
+
+	if cfg.NixosConfig != "" {
+		err = os.Remove(cfg.Container.NixosConfigPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resourceNixOSContainerCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	// A trick to prevent prematurely writing nix expressions to disks path
+	// when this is the first diff.
+	if d.HasChange("nixos_config") {
+		d.SetNewComputed("container_system")
+		return planLastLogPath(d, m)
+	}
+
+	cfg, err := getNixosContainerConfig(d, m)
+	if err != nil {
+		return err
+	}
+	// Only applies are logged, or every plan would add a file to log_dir.
+	cfg.Container.Log = nil
+
+	desiredSystem, err := cfg.DoBuild()
+	if err != nil {
+		log.Printf("build failed, assuming this is because of generated configs. err=%s", err.Error())
+		d.SetNewComputed("container_system")
+		return planLastLogPath(d, m)
+	}
+
+	if d.Get("container_system").(string) != desiredSystem {
+		d.SetNew("container_system", desiredSystem)
+		return planLastLogPath(d, m)
+	}
+
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// A nixos image, ready to upload to a cloud provider or write to a disk.
+func resourceNixOSImage() *schema.Resource {
+	return &schema.Resource{
+		Create:        resourceNixOSImageCreateUpdate,
+		Update:        resourceNixOSImageCreateUpdate,
+		Read:          resourceNixOSImageRead,
+		Delete:        resourceNixOSImageDelete,
+		Exists:        resourceNixOSImageExists,
+		CustomizeDiff: resourceNixOSImageCustomizeDiff,
+
+		Schema: map[string]*schema.Schema{
+			"nixos_config": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"nixos_config_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"format": &schema.Schema{
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validation.StringInSlice(nix.ImageFormats(), false),
+			},
+			"disk_layout_module": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"builders": buildersSchema(),
+			"nix_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"out_link": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"store_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"image_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"image_size": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"image_sha256": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"log_dir":       logDirSchema(),
+			"last_log_path": lastLogPathSchema(),
+		},
+	}
+}
+
+type nixosImageResourceConfig struct {
+	NixosConfig     string
+	NixosConfigPath string
+	DiskModule      string
+	Format          string
+	NixPath         string
+	OutLink         string
+	Builders        nix.Builders
+	Log             *nix.CommandLog
+}
+
+func (cfg *nixosImageResourceConfig) DoBuild() (string, error) {
+	return cfg.doBuild(&cfg.OutLink)
+}
+
+func (cfg *nixosImageResourceConfig) DoBuildNoLink() (string, error) {
+	return cfg.doBuild(nil)
+}
+
+func (cfg *nixosImageResourceConfig) doBuild(outLink *string) (string, error) {
+	if cfg.NixosConfig != "" {
+		err := writeManagedFile(cfg.NixosConfigPath, cfg.NixosConfig)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return nix.BuildImage(cfg.NixPath, cfg.NixosConfigPath, cfg.DiskModule, cfg.Format, outLink, cfg.Builders, cfg.Log)
+}
+
+func getNixosImageConfig(d resourceLike, m interface{}) (nixosImageResourceConfig, error) {
+	nixPath := os.Getenv("NIX_PATH")
+	if p, ok := d.GetOk("nix_path"); ok {
+		nixPath = p.(string)
+	}
+
+	nixosConfig, _ := d.GetOk("nixos_config")
+
+	nixosConfigPath, err := filepath.Abs(d.Get("nixos_config_path").(string))
+	if err != nil {
+		return nixosImageResourceConfig{}, err
+	}
+
+	outLink, err := filepath.Abs(d.Get("out_link").(string))
+	if err != nil {
+		return nixosImageResourceConfig{}, err
+	}
+
+	cmdLog, err := getCommandLog(d, m)
+	if err != nil {
+		return nixosImageResourceConfig{}, err
+	}
+
+	return nixosImageResourceConfig{
+		NixosConfig:     nixosConfig.(string),
+		NixosConfigPath: nixosConfigPath,
+		DiskModule:      d.Get("disk_layout_module").(string),
+		Format:          d.Get("format").(string),
+		NixPath:         nixPath,
+		OutLink:         outLink,
+		Builders:        getBuilders(d, m),
+		Log:             cmdLog,
+	}, nil
+}
+
+func resourceNixOSImageCreateUpdate(d *schema.ResourceData, m interface{}) error {
+
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	cfg, err := getNixosImageConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	if d.HasChange("out_link") {
+		old, _ := d.GetChange("out_link")
+		err = os.Remove(old.(string))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Delete the old config if it was under out control.
+	if d.HasChange("nixos_config_path") {
+		oldConfig, _ := d.GetChange("nixos_config")
+		if oldConfig != "" {
+			old, _ := d.GetChange("nixos_config_path")
+			err = os.Remove(old.(string))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	linkExists := false
+	_, err = os.Readlink(cfg.OutLink)
+	if err == nil {
+		linkExists = true
+	}
+
+	if d.IsNewResource() || d.HasChange("store_path") || d.HasChange("format") || !linkExists {
+		storePath, err := cfg.DoBuild()
+		if err != nil {
+			return err
+		}
+
+		err = setLastLogPath(d, cfg.Log)
+		if err != nil {
+			return err
+		}
+
+		// Hashing large images is slow, so only do it when they change.
+		imagePath, err := nix.FindImageFile(storePath)
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Stat(imagePath)
+		if err != nil {
+			return err
+		}
+
+		imageSHA256, err := nix.FileSHA256(imagePath)
+		if err != nil {
+			return err
+		}
+
+		err = d.Set("image_path", imagePath)
+		if err != nil {
+			return err
+		}
+
+		err = d.Set("image_size", int(info.Size()))
+		if err != nil {
+			return err
+		}
+
+		err = d.Set("image_sha256", imageSHA256)
+		if err != nil {
+			return err
+		}
+	}
+
+	return resourceNixOSImageRead(d, m)
+}
+
+func resourceNixOSImageRead(d *schema.ResourceData, m interface{}) error {
+
+	cfg, err := getNixosImageConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	storePath, err := os.Readlink(cfg.OutLink)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("store_path", storePath)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceNixOSImageDelete(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixosImageConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	if cfg.NixosConfig != "" {
+		err = os.Remove(cfg.NixosConfigPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err = os.Remove(cfg.OutLink)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func resourceNixOSImageExists(d *schema.ResourceData, m interface{}) (bool, error) {
+	cfg, err := getNixosImageConfig(d, m)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Readlink(cfg.OutLink)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func resourceNixOSImageCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	// A trick to prevent prematurely writing nix expressions to disks path
+	// when this is the first diff.
+	if d.HasChange("nixos_config") || d.HasChange("disk_layout_module") || d.HasChange("format") {
+		return setNixOSImageComputed(d, m)
+	}
+
+	cfg, err := getNixosImageConfig(d, m)
+	if err != nil {
+		return err
+	}
+	// Only applies are logged, or every plan would add a file to log_dir.
+	cfg.Log = nil
+
+	desiredBuild, err := cfg.DoBuildNoLink()
+	if err != nil {
+		log.Printf("build failed, assuming this is because of generated configs. err=%s", err.Error())
+		return setNixOSImageComputed(d, m)
+	}
+	if d.Get("store_path").(string) != desiredBuild {
+		return setNixOSImageComputed(d, m)
+	}
+
+	return nil
+}
+
+func setNixOSImageComputed(d *schema.ResourceDiff, m interface{}) error {
+	d.SetNewComputed("store_path")
+	d.SetNewComputed("image_path")
+	d.SetNewComputed("image_size")
+	d.SetNewComputed("image_sha256")
+	return planLastLogPath(d, m)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// TestResourceNixOSImagePlanLog checks a plan that rebuilds the image expects
+// a new last_log_path, without logging the build it made while planning.
+func TestResourceNixOSImagePlanLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nixos-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, "bin")
+	err = os.Mkdir(bin, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(bin, "nix-build"), []byte("#!/bin/sh\necho /nix/store/bbbb-nixos-disk-image\n"), 0755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	logDir := filepath.Join(dir, "logs")
+	config := map[string]interface{}{
+		"nixos_config_path": filepath.Join(dir, "configuration.nix"),
+		"format":            "qcow2",
+		"out_link":          filepath.Join(dir, "image"),
+		"log_dir":           logDir,
+	}
+	state := &terraform.InstanceState{ID: "image", Attributes: map[string]string{
+		"store_path": "/nix/store/aaaa-nixos-disk-image",
+		"image_path": "/nix/store/aaaa-nixos-disk-image/nixos.qcow2",
+	}}
+	for k, v := range config {
+		state.Attributes[k] = v.(string)
+	}
+
+	diff, err := resourceNixOSImage().Diff(state, terraform.NewResourceConfigRaw(config), &providerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"store_path", "last_log_path"} {
+		if diff == nil || diff.Attributes[k] == nil || !diff.Attributes[k].NewComputed {
+			t.Fatalf("%s is not planned to change: %v", k, diff)
+		}
+	}
+
+	if _, err := os.Stat(logDir); !os.IsNotExist(err) {
+		t.Fatalf("the plan wrote to log_dir: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// A fresh linux host we turn into a nixos server.
+func resourceNixOSInstall() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceNixOSInstallCreate,
+		Update: resourceNixOSInstallUpdate,
+		Read:   resourceNixOSInstallRead,
+		Delete: resourceNixOSInstallDelete,
+
+		Schema: map[string]*schema.Schema{
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+				ForceNew: true,
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+				ForceNew: true,
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  600,
+				ForceNew: true,
+			},
+			"builders": buildersSchema(),
+			"nix_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+			"nixos_config": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+			"nixos_config_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"install_method": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      nix.InstallMethodKexec,
+				ForceNew:     true,
+				ValidateFunc: validation.StringInSlice([]string{nix.InstallMethodKexec, nix.InstallMethodInstaller, nix.InstallMethodLustrate}, false),
+			},
+			"kexec_url": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  nix.DefaultKexecURL,
+				ForceNew: true,
+			},
+			"partition_script": &schema.Schema{
+				Type:      schema.TypeString,
+				Optional:  true,
+				ForceNew:  true,
+				Sensitive: true,
+			},
+			"reboot": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+				ForceNew: true,
+			},
+			"installed_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"log_dir":       logDirSchema(),
+			"last_log_path": lastLogPathSchema(),
+		},
+	}
+}
+
+type nixosInstallResourceConfig struct {
+	NixosConfig string
+	Install     nix.InstallConfig
+}
+
+func getNixosInstallConfig(d resourceLike, m interface{}) (nixosInstallResourceConfig, error) {
+	nixPath, ok := d.GetOk("nix_path")
+	if !ok {
+		nixPath = os.Getenv("NIX_PATH")
+	}
+
+	nixosConfig, _ := d.GetOk("nixos_config")
+
+	nixosConfigPath, err := filepath.Abs(d.Get("nixos_config_path").(string))
+	if err != nil {
+		return nixosInstallResourceConfig{}, err
+	}
+
+	cmdLog, err := getCommandLog(d, m)
+	if err != nil {
+		return nixosInstallResourceConfig{}, err
+	}
+
+	return nixosInstallResourceConfig{
+		NixosConfig: nixosConfig.(string),
+		Install: nix.InstallConfig{
+			TargetHost:      d.Get("target_host").(string),
+			TargetUser:      d.Get("target_user").(string),
+			SSHOpts:         d.Get("ssh_opts").(string),
+			SSHTimeout:      time.Duration(d.Get("ssh_timeout").(int)) * time.Second,
+			NixPath:         nixPath.(string),
+			NixosConfigPath: nixosConfigPath,
+			Method:          d.Get("install_method").(string),
+			KexecURL:        d.Get("kexec_url").(string),
+			PartitionScript: d.Get("partition_script").(string),
+			Reboot:          d.Get("reboot").(bool),
+			Builders:        getBuilders(d, m),
+			Log:             cmdLog,
+		},
+	}, nil
+}
+
+func resourceNixOSInstallCreate(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixosInstallConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	if cfg.NixosConfig != "" {
+		err = writeManagedFile(cfg.Install.NixosConfigPath, cfg.NixosConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	system, err := nix.Install(&cfg.Install)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(randomID())
+
+	err = d.Set("installed_system", system)
+	if err != nil {
+		return err
+	}
+
+	err = setLastLogPath(d, cfg.Install.Log)
+	if err != nil {
+		return err
+	}
+
+	return resourceNixOSInstallRead(d, m)
+}
+
+// The install is a one off event, the host is managed by nix_nixos afterwards.
+// Builders are only used while installing, changing them changes nothing on the host.
+func resourceNixOSInstallUpdate(d *schema.ResourceData, m interface{}) error {
+	return resourceNixOSInstallRead(d, m)
+}
+
+func resourceNixOSInstallRead(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
+
+func resourceNixOSInstallDelete(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixosInstallConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	if cfg.NixosConfig != "" {
+		err = os.Remove(cfg.Install.NixosConfigPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
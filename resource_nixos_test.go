@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/configs/hcl2shim"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// fakeCommands puts scripts recording that they ran first on the PATH. The
+// returned function lists the commands that ran.
+func fakeCommands(t *testing.T, names ...string) func() []string {
+	dir, err := ioutil.TempDir("", "fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	calls := filepath.Join(dir, "calls")
+	for _, name := range names {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\necho "+name+" >> '"+calls+"'\nexit 1\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+
+	return func() []string {
+		b, _ := ioutil.ReadFile(calls)
+		return strings.Fields(string(b))
+	}
+}
+
+func TestResourceNixOSValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:    "ssh without target_host",
+			config:  map[string]interface{}{},
+			wantErr: "target_host is required with the ssh transport",
+		},
+		{
+			name:    "docker without target_host",
+			config:  map[string]interface{}{"transport": "docker"},
+			wantErr: "target_host is required with the docker transport",
+		},
+		{
+			name:   "ssh",
+			config: map[string]interface{}{"target_host": "web1.example.com"},
+		},
+		{
+			name:   "local",
+			config: map[string]interface{}{"transport": "local"},
+		},
+		{
+			name:    "sudo_password without use_sudo",
+			config:  map[string]interface{}{"target_host": "web1.example.com", "sudo_password": "secret"},
+			wantErr: "sudo_password is only used with use_sudo = true",
+		},
+		{
+			name:   "sudo_password",
+			config: map[string]interface{}{"target_host": "web1.example.com", "use_sudo": true, "sudo_password": "secret"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := map[string]interface{}{
+				"nixos_config_path": "/etc/nixos/configuration.nix",
+				// A new config plans the switch without building.
+				"nixos_config": "{ }",
+			}
+			for k, v := range tc.config {
+				raw[k] = v
+			}
+
+			_, err := resourceNixOS().Diff(nil, terraform.NewResourceConfigRaw(raw), &providerConfig{})
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestResourceNixOSUnknownPin checks a pin that is only known at apply is
+// neither resolved on the target nor ignored in favour of nixos_config_path.
+func TestResourceNixOSUnknownPin(t *testing.T) {
+	for _, pin := range []string{"pin_generation", "pin_system"} {
+		t.Run(pin, func(t *testing.T) {
+			calls := fakeCommands(t, "ssh", "nixos-rebuild", "nix-build", "nix-instantiate")
+
+			raw := map[string]interface{}{
+				"target_host":       "web1.example.com",
+				"nixos_config_path": "/etc/nixos/configuration.nix",
+				pin:                 hcl2shim.UnknownVariableValue,
+			}
+			diff, err := resourceNixOS().Diff(nil, terraform.NewResourceConfigRaw(raw), &providerConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ran := calls(); len(ran) != 0 {
+				t.Fatalf("planning ran %v", ran)
+			}
+			if attr := diff.Attributes["nixos_system"]; attr == nil || !attr.NewComputed {
+				t.Fatalf("nixos_system is not planned as computed: %v", attr)
+			}
+		})
+	}
+}
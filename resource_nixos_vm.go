@@ -0,0 +1,272 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// A local nixos vm for testing configurations.
+func resourceNixOSVM() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceNixOSVMCreateUpdate,
+		Update: resourceNixOSVMCreateUpdate,
+		Read:   resourceNixOSVMRead,
+		Delete: resourceNixOSVMDelete,
+
+		CustomizeDiff: resourceNixOSVMCustomizeDiff,
+
+		Schema: map[string]*schema.Schema{
+			"nixos_config": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"nixos_config_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"builders": buildersSchema(),
+			"nix_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"state_dir": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"ssh_port": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Computed: true,
+			},
+			"kvm": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"memory": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  1024,
+			},
+			"vm_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"pid": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"log_dir":       logDirSchema(),
+			"last_log_path": lastLogPathSchema(),
+		},
+	}
+}
+
+type nixosVMResourceConfig struct {
+	NixosConfig string
+	VM          nix.VMConfig
+}
+
+func getNixosVMConfig(d resourceLike, m interface{}) (nixosVMResourceConfig, error) {
+	nixPath := os.Getenv("NIX_PATH")
+	if p, ok := d.GetOk("nix_path"); ok {
+		nixPath = p.(string)
+	}
+
+	nixosConfig, _ := d.GetOk("nixos_config")
+
+	nixosConfigPath, err := filepath.Abs(d.Get("nixos_config_path").(string))
+	if err != nil {
+		return nixosVMResourceConfig{}, err
+	}
+
+	stateDir, err := filepath.Abs(d.Get("state_dir").(string))
+	if err != nil {
+		return nixosVMResourceConfig{}, err
+	}
+
+	cmdLog, err := getCommandLog(d, m)
+	if err != nil {
+		return nixosVMResourceConfig{}, err
+	}
+
+	return nixosVMResourceConfig{
+		NixosConfig: nixosConfig.(string),
+		VM: nix.VMConfig{
+			NixPath:         nixPath,
+			NixosConfigPath: nixosConfigPath,
+			StateDir:        stateDir,
+			SSHPort:         d.Get("ssh_port").(int),
+			KVM:             d.Get("kvm").(bool),
+			MemoryMB:        d.Get("memory").(int),
+			Builders:        getBuilders(d, m),
+			Log:             cmdLog,
+		},
+	}, nil
+}
+
+func resourceNixOSVMCreateUpdate(d *schema.ResourceData, m interface{}) error {
+
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	cfg, err := getNixosVMConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	// Delete the old config if it was under out control.
+	if d.HasChange("nixos_config_path") {
+		oldConfig, _ := d.GetChange("nixos_config")
+		if oldConfig != "" {
+			old, _ := d.GetChange("nixos_config_path")
+			err = os.Remove(old.(string))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	if cfg.NixosConfig != "" {
+		err = writeManagedFile(cfg.VM.NixosConfigPath, cfg.NixosConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The build is only logged when the plan expected a new system.
+	if !d.IsNewResource() && !d.HasChange("vm_system") {
+		cfg.VM.Log = nil
+	}
+
+	vmSystem, err := nix.BuildVM(&cfg.VM)
+	if err != nil {
+		return err
+	}
+
+	err = setLastLogPath(d, cfg.VM.Log)
+	if err != nil {
+		return err
+	}
+
+	pid := d.Get("pid").(int)
+	running := nix.VMRunning(&cfg.VM, pid)
+
+	if running && vmSystem == d.Get("vm_system").(string) && !d.HasChange("ssh_port") && !d.HasChange("kvm") && !d.HasChange("memory") {
+		return resourceNixOSVMRead(d, m)
+	}
+
+	err = nix.StopVM(&cfg.VM, pid)
+	if err != nil {
+		return err
+	}
+
+	if cfg.VM.SSHPort == 0 {
+		cfg.VM.SSHPort, err = nix.FreePort()
+		if err != nil {
+			return err
+		}
+	}
+
+	pid, err = nix.StartVM(&cfg.VM, vmSystem)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("vm_system", vmSystem)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("ssh_port", cfg.VM.SSHPort)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("pid", pid)
+	if err != nil {
+		return err
+	}
+
+	return resourceNixOSVMRead(d, m)
+}
+
+func resourceNixOSVMRead(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixosVMConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	// A stopped vm is recreated on the next apply.
+	if !nix.VMRunning(&cfg.VM, d.Get("pid").(int)) {
+		d.SetId("")
+	}
+
+	return nil
+}
+
+func resourceNixOSVMDelete(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixosVMConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	err = nix.StopVM(&cfg.VM, d.Get("pid").(int))
+	if err != nil {
+		return err
+	}
+
+	err = nix.RemoveVMState(&cfg.VM)
+	if err != nil {
+		return err
+	}
+
+	if cfg.NixosConfig != "" {
+		err = os.Remove(cfg.VM.NixosConfigPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resourceNixOSVMCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	// A trick to prevent prematurely writing nix expressions to disks path
+	// when this is the first diff.
+	if d.HasChange("nixos_config") {
+		d.SetNewComputed("vm_system")
+		d.SetNewComputed("pid")
+		return planLastLogPath(d, m)
+	}
+
+	cfg, err := getNixosVMConfig(d, m)
+	if err != nil {
+		return err
+	}
+	// Only applies are logged, or every plan would add a file to log_dir.
+	cfg.VM.Log = nil
+
+	desiredSystem, err := nix.BuildVM(&cfg.VM)
+	if err != nil {
+		log.Printf("build failed, assuming this is because of generated configs. err=%s", err.Error())
+		d.SetNewComputed("vm_system")
+		d.SetNewComputed("pid")
+		return planLastLogPath(d, m)
+	}
+
+	if d.Get("vm_system").(string) != desiredSystem {
+		d.SetNewComputed("vm_system")
+		d.SetNewComputed("pid")
+		return planLastLogPath(d, m)
+	}
+
+	return nil
+}
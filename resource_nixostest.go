@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// A nixos integration test that must pass before anything depending on it is applied.
+func resourceNixOSTest() *schema.Resource {
+	return &schema.Resource{
+		Create:        resourceNixOSTestCreateUpdate,
+		Update:        resourceNixOSTestCreateUpdate,
+		Read:          resourceNixOSTestRead,
+		Delete:        resourceNixOSTestDelete,
+		CustomizeDiff: resourceNixOSTestCustomizeDiff,
+
+		Schema: map[string]*schema.Schema{
+			"expression": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"expression_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"builders": buildersSchema(),
+			"nix_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"log_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"drv_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"passed_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+type nixosTestResourceConfig struct {
+	Expression     string
+	ExpressionPath string
+	NixPath        string
+	LogPath        string
+	Builders       nix.Builders
+}
+
+func (cfg *nixosTestResourceConfig) Instantiate() (string, error) {
+	if cfg.Expression != "" {
+		err := writeManagedFile(cfg.ExpressionPath, cfg.Expression)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return nix.InstantiateExpression(cfg.NixPath, cfg.ExpressionPath)
+}
+
+func getNixosTestConfig(d resourceLike, m interface{}) (nixosTestResourceConfig, error) {
+	nixPath := os.Getenv("NIX_PATH")
+	if p, ok := d.GetOk("nix_path"); ok {
+		nixPath = p.(string)
+	}
+
+	expression, _ := d.GetOk("expression")
+
+	expressionPath, err := filepath.Abs(d.Get("expression_path").(string))
+	if err != nil {
+		return nixosTestResourceConfig{}, err
+	}
+
+	logPath, err := filepath.Abs(d.Get("log_path").(string))
+	if err != nil {
+		return nixosTestResourceConfig{}, err
+	}
+
+	return nixosTestResourceConfig{
+		Expression:     expression.(string),
+		ExpressionPath: expressionPath,
+		NixPath:        nixPath,
+		LogPath:        logPath,
+		Builders:       getBuilders(d, m),
+	}, nil
+}
+
+func resourceNixOSTestCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixosTestConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	// Delete the old expression if it was under out control.
+	if d.HasChange("expression_path") {
+		oldExpression, _ := d.GetChange("expression")
+		if oldExpression != "" {
+			old, _ := d.GetChange("expression_path")
+			err = os.Remove(old.(string))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	drvPath, err := cfg.Instantiate()
+	if err != nil {
+		return err
+	}
+
+	// A failing test must not leave behind state that looks like it passed.
+	d.Partial(true)
+
+	oldDrvPath, _ := d.GetChange("drv_path")
+	if d.IsNewResource() || drvPath != oldDrvPath.(string) {
+		passedSystem, err := nix.RunTest(drvPath, cfg.LogPath, cfg.Builders)
+		if err != nil {
+			return err
+		}
+
+		err = d.Set("passed_system", passedSystem)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.Set("drv_path", drvPath)
+	if err != nil {
+		return err
+	}
+
+	d.Partial(false)
+
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	return resourceNixOSTestRead(d, m)
+}
+
+// Test results are immutable, there is nothing to refresh.
+func resourceNixOSTestRead(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
+
+func resourceNixOSTestDelete(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixosTestConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Expression != "" {
+		err = os.Remove(cfg.ExpressionPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resourceNixOSTestCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	// A trick to prevent prematurely writing nix expressions to disks path
+	// when this is the first diff.
+	if d.HasChange("expression") {
+		d.SetNewComputed("drv_path")
+		d.SetNewComputed("passed_system")
+		return nil
+	}
+
+	cfg, err := getNixosTestConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	drvPath, err := cfg.Instantiate()
+	if err != nil {
+		log.Printf("evaluation failed, assuming this is because of generated expression. err=%s", err.Error())
+		d.SetNewComputed("drv_path")
+		d.SetNewComputed("passed_system")
+		return nil
+	}
+
+	if d.Get("drv_path").(string) != drvPath {
+		err = d.SetNew("drv_path", drvPath)
+		if err != nil {
+			return err
+		}
+		d.SetNewComputed("passed_system")
+	}
+
+	return nil
+}
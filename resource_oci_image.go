@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/andrewchambers/terraform-provider-nix/oci"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// A container image built by nix, optionally pushed to a registry.
+func resourceOCIImage() *schema.Resource {
+	return &schema.Resource{
+		Create:        resourceOCIImageCreateUpdate,
+		Update:        resourceOCIImageCreateUpdate,
+		Read:          resourceOCIImageRead,
+		Delete:        resourceOCIImageDelete,
+		CustomizeDiff: resourceOCIImageCustomizeDiff,
+
+		Schema: map[string]*schema.Schema{
+			"archive_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"repository": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"tags": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"insecure": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"username": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"password": &schema.Schema{
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
+			},
+			"manifest_digest": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"config_digest": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"layer_digests": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"repo_tags": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+		},
+	}
+}
+
+// imageTags returns the tags to push, defaulting to those recorded in the archive.
+func imageTags(d resourceLike, img *oci.Image) []string {
+	tags := []string{}
+	for _, tag := range d.Get("tags").([]interface{}) {
+		tags = append(tags, tag.(string))
+	}
+	if len(tags) != 0 {
+		return tags
+	}
+
+	for _, repoTag := range img.RepoTags {
+		idx := strings.LastIndex(repoTag, ":")
+		if idx >= 0 && !strings.Contains(repoTag[idx:], "/") {
+			tags = append(tags, repoTag[idx+1:])
+		}
+	}
+	if len(tags) == 0 {
+		// Push by digest alone.
+		tags = append(tags, img.ManifestDigest)
+	}
+
+	return tags
+}
+
+func resourceOCIImageCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	img, err := oci.Load(d.Get("archive_path").(string))
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	if repository, ok := d.GetOk("repository"); ok {
+		host, name := oci.ParseReference(repository.(string))
+		registry := &oci.Registry{
+			Host:     host,
+			Insecure: d.Get("insecure").(bool),
+			Username: d.Get("username").(string),
+			Password: d.Get("password").(string),
+		}
+
+		err = registry.Push(name, img, imageTags(d, img))
+		if err != nil {
+			return err
+		}
+	}
+
+	layerDigests := make([]string, 0, len(img.Layers))
+	for _, layer := range img.Layers {
+		layerDigests = append(layerDigests, layer.Digest)
+	}
+
+	values := map[string]interface{}{
+		"manifest_digest": img.ManifestDigest,
+		"config_digest":   img.Config.Digest,
+		"layer_digests":   layerDigests,
+		"repo_tags":       img.RepoTags,
+	}
+
+	for k, v := range values {
+		err = d.Set(k, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	return resourceOCIImageRead(d, m)
+}
+
+// Digests are derived from the archive, there is nothing to refresh.
+func resourceOCIImageRead(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
+
+// Pushed images are left in the registry, which may be serving them.
+func resourceOCIImageDelete(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
+
+func resourceOCIImageCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	if d.HasChange("archive_path") {
+		d.SetNewComputed("manifest_digest")
+		d.SetNewComputed("config_digest")
+		d.SetNewComputed("layer_digests")
+		d.SetNewComputed("repo_tags")
+	}
+	return nil
+}
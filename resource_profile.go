@@ -0,0 +1,150 @@
+package main
+
+import (
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// A nix profile on a remote host, which need not run nixos.
+func resourceProfile() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceProfileCreateUpdate,
+		Update: resourceProfileCreateUpdate,
+		Read:   resourceProfileRead,
+		Delete: resourceProfileDelete,
+
+		CustomizeDiff: resourceProfileCustomizeDiff,
+
+		Schema: map[string]*schema.Schema{
+			"store_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"profile_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+				ForceNew: true,
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"use_substitutes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compress": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compression": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      nix.CompressionNone,
+				ValidateFunc: validation.StringInSlice([]string{nix.CompressionNone, nix.CompressionGzip, nix.CompressionZstd}, false),
+			},
+			"rollback_on_destroy": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"generation": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceProfileCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	cfg := getCopyClosureConfig(d)
+	profile := d.Get("profile_path").(string)
+	storePath := d.Get("store_path").(string)
+
+	err := nix.WaitForSSH(cfg.Target.User, cfg.Target.Host, cfg.Target.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+
+	err = nix.CopyClosure(&cfg, storePath)
+	if err != nil {
+		return err
+	}
+
+	err = nix.SetProfile(&cfg.Target, profile, storePath)
+	if err != nil {
+		return err
+	}
+
+	return resourceProfileRead(d, m)
+}
+
+func resourceProfileRead(d *schema.ResourceData, m interface{}) error {
+	cfg := getCopyClosureConfig(d)
+
+	storePath, generation, err := nix.ReadProfile(&cfg.Target, d.Get("profile_path").(string))
+	if err != nil {
+		return err
+	}
+
+	if storePath == "" {
+		d.SetId("")
+		return nil
+	}
+
+	err = d.Set("store_path", storePath)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("generation", generation)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceProfileDelete(d *schema.ResourceData, m interface{}) error {
+	if !d.Get("rollback_on_destroy").(bool) {
+		return nil
+	}
+
+	cfg := getCopyClosureConfig(d)
+
+	return nix.RollbackProfile(&cfg.Target, d.Get("profile_path").(string))
+}
+
+func resourceProfileCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	if d.HasChange("store_path") {
+		d.SetNewComputed("generation")
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// Systemd units built by nix, deployed to a generic linux host.
+func resourceSystemdUnits() *schema.Resource {
+	return &schema.Resource{
+		Create:        resourceSystemdUnitsCreateUpdate,
+		Update:        resourceSystemdUnitsCreateUpdate,
+		Read:          resourceSystemdUnitsRead,
+		Delete:        resourceSystemdUnitsDelete,
+		CustomizeDiff: resourceSystemdUnitsCustomizeDiff,
+
+		Schema: map[string]*schema.Schema{
+			"units_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"profile_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "/nix/var/nix/profiles/systemd-units",
+				ForceNew: true,
+			},
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+				ForceNew: true,
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"use_substitutes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compress": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"compression": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      nix.CompressionNone,
+				ValidateFunc: validation.StringInSlice([]string{nix.CompressionNone, nix.CompressionGzip, nix.CompressionZstd}, false),
+			},
+			"units": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+		},
+	}
+}
+
+func resourceSystemdUnitsCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	cfg := getCopyClosureConfig(d)
+	unitsPath := d.Get("units_path").(string)
+
+	err := nix.WaitForSSH(cfg.Target.User, cfg.Target.Host, cfg.Target.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+
+	err = nix.CopyClosure(&cfg, unitsPath)
+	if err != nil {
+		return err
+	}
+
+	changes, err := nix.DeployUnits(&cfg.Target, d.Get("profile_path").(string), unitsPath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] units on %s started: %v restarted: %v stopped: %v", cfg.Target.Host, changes.Started, changes.Restarted, changes.Stopped)
+
+	err = d.Set("units", changes.Units)
+	if err != nil {
+		return err
+	}
+
+	return resourceSystemdUnitsRead(d, m)
+}
+
+func resourceSystemdUnitsRead(d *schema.ResourceData, m interface{}) error {
+	cfg := getCopyClosureConfig(d)
+
+	unitsPath, _, err := nix.ReadProfile(&cfg.Target, d.Get("profile_path").(string))
+	if err != nil {
+		return err
+	}
+
+	if unitsPath == "" {
+		d.SetId("")
+		return nil
+	}
+
+	err = d.Set("units_path", unitsPath)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceSystemdUnitsDelete(d *schema.ResourceData, m interface{}) error {
+	cfg := getCopyClosureConfig(d)
+
+	return nix.RemoveUnits(&cfg.Target, d.Get("profile_path").(string))
+}
+
+func resourceSystemdUnitsCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	if d.HasChange("units_path") {
+		d.SetNewComputed("units")
+	}
+	return nil
+}